@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+func loadAliases(fn string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := map[string]string{}
+	if err := json.Unmarshal(b, &aliases); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+func resolveAliases(aliases map[string]string) {
+	if ref, ok := aliases[selected]; ok {
+		selected = ref
+	}
+
+	if ref, ok := aliases[name]; ok {
+		var t string
+		name, t = splitReference(ref)
+		if tag == "" {
+			tag = t
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	_ "crypto/sha512"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/docker/distribution/digest"
+	trust "github.com/docker/libtrust"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// VerificationManifest is written to archival packages and records what is
+// needed to check them long after the tooling that created them is gone
+type VerificationManifest struct {
+	FormatVersion    int                        `json:"formatVersion"`
+	Tool             string                     `json:"tool"`
+	ToolVersion      string                     `json:"toolVersion"`
+	GoVersion        string                     `json:"goVersion"`
+	Created          time.Time                  `json:"created"`
+	SignatureFormat  string                     `json:"signatureFormat"`
+	DigestAlgorithms []digest.Algorithm         `json:"digestAlgorithms"`
+	Files            map[string][]digest.Digest `json:"files"`
+	Keys             []VerificationKey          `json:"keys"`
+}
+
+type VerificationKey struct {
+	KeyID     string          `json:"keyId"`
+	Algorithm string          `json:"alg"`
+	JWK       json.RawMessage `json:"jwk"`
+	PEM       string          `json:"pem"`
+}
+
+// every archived file is digested with several algorithms, so the package
+// stays checkable should one of them be broken
+var archiveAlgorithms = []digest.Algorithm{digest.SHA256, digest.SHA512}
+
+type multiDigester []digest.Digester
+
+func newMultiDigester() multiDigester {
+	md := make(multiDigester, len(archiveAlgorithms))
+	for i, alg := range archiveAlgorithms {
+		md[i] = alg.New()
+	}
+	return md
+}
+
+func (md multiDigester) Write(p []byte) (int, error) {
+	for _, d := range md {
+		d.Hash().Write(p)
+	}
+	return len(p), nil
+}
+
+func (md multiDigester) Digests() []digest.Digest {
+	out := make([]digest.Digest, len(md))
+	for i, d := range md {
+		out[i] = d.Digest()
+	}
+	return out
+}
+
+func multiDigest(r io.Reader) ([]digest.Digest, error) {
+	md := newMultiDigester()
+	if _, err := io.Copy(md, r); err != nil {
+		return nil, err
+	}
+	return md.Digests(), nil
+}
+
+// verificationKeys describes the keys of the given signatures, which are
+// the JWS objects returned by Signatures in the order Verify checks them
+func verificationKeys(keys []trust.PublicKey, sigs [][]byte) ([]VerificationKey, error) {
+	out := make([]VerificationKey, len(keys))
+	for i, k := range keys {
+		var jws struct {
+			Header struct {
+				Algorithm string `json:"alg"`
+			} `json:"header"`
+		}
+		if i < len(sigs) {
+			json.Unmarshal(sigs[i], &jws)
+		}
+
+		jwk, err := k.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		block, err := k.PEMBlock()
+		if err != nil {
+			return nil, err
+		}
+		out[i] = VerificationKey{
+			KeyID:     k.KeyID(),
+			Algorithm: jws.Header.Algorithm,
+			JWK:       jwk,
+			PEM:       string(pem.EncodeToMemory(block)),
+		}
+	}
+	return out, nil
+}
+
+func containsDigest(ds []digest.Digest, d digest.Digest) bool {
+	for _, x := range ds {
+		if x == d {
+			return true
+		}
+	}
+	return false
+}
+
+// version is set when building releases, with
+// -ldflags "-X main.version=v1.2.3"
+var version string
+
+// toolVersion names the build that is running, without a release version
+// it is the commit the go tool recorded
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	v, dirty := info.Main.Version, false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if v == "" {
+		return "unknown"
+	}
+	if dirty {
+		v += "-dirty"
+	}
+	return v
+}
+
+func newVerificationManifest(created time.Time) *VerificationManifest {
+	return &VerificationManifest{
+		FormatVersion:    1,
+		Tool:             "docker-manifest",
+		ToolVersion:      toolVersion(),
+		GoVersion:        runtime.Version(),
+		Created:          created,
+		SignatureFormat:  "libtrust JWS, docker image manifest schema 1",
+		DigestAlgorithms: archiveAlgorithms,
+		Files:            map[string][]digest.Digest{},
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func manifestFileName(ref *ImageRef) string {
+	return strings.Replace(ref.Repo, "/", "_", -1) + "_" + ref.Tag + ".json"
+}
+
+func writeArchive(src, dest string, refs []*ImageRef, manifests [][]byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), ".docker-manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	tw := tar.NewWriter(w)
+	tr := tar.NewReader(bufio.NewReader(in))
+	// manifests get the newest mtime of the archive rather than the current
+	// time, so the output is the same every time
+	var mtime time.Time
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			tmp.Close()
+			return err
+		}
+
+		if strings.HasPrefix(hdr.Name, "manifests/") {
+			continue
+		}
+		if hdr.ModTime.After(mtime) {
+			mtime = hdr.ModTime
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	for i, ref := range refs {
+		hdr := &tar.Header{
+			Name:     "manifests/" + manifestFileName(ref),
+			Mode:     0644,
+			Size:     int64(len(manifests[i])),
+			ModTime:  mtime,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := io.Copy(tw, bytes.NewReader(manifests[i])); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
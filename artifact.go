@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	flag "github.com/docker/docker/pkg/mflag"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyMediaType    = "application/vnd.oci.empty.v1+json"
+	titleAnnotation      = "org.opencontainers.image.title"
+)
+
+// ArtifactManifest is an OCI image manifest carrying arbitrary blobs, the
+// config is the empty descriptor and artifactType says what it holds
+type ArtifactManifest struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	MediaType     string             `json:"mediaType"`
+	ArtifactType  string             `json:"artifactType"`
+	Config        LayoutDescriptor   `json:"config"`
+	Layers        []LayoutDescriptor `json:"layers"`
+	Subject       *LayoutDescriptor  `json:"subject,omitempty"`
+	Annotations   map[string]string  `json:"annotations,omitempty"`
+}
+
+// subjectDescriptor describes the manifest in fn the way a registry stores
+// it, signed schema1 manifests are addressed by their payload digest
+func subjectDescriptor(fn string) (*LayoutDescriptor, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var m struct {
+		MediaType  string          `json:"mediaType"`
+		Signatures json.RawMessage `json:"signatures"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error parsing subject manifest: %s", err.Error())
+	}
+
+	desc := &LayoutDescriptor{MediaType: m.MediaType}
+	if desc.MediaType == "" {
+		desc.MediaType = manifest.ManifestMediaType
+		if m.Signatures != nil {
+			desc.MediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+		}
+	}
+
+	// size and digest both cover the payload, like distribution's Canonical
+	if m.Signatures != nil {
+		jsig, err := trust.ParsePrettySignature(b, "signatures")
+		if err != nil {
+			return nil, fmt.Errorf("error parsing subject manifest: %s", err.Error())
+		}
+		if b, err = jsig.Payload(); err != nil {
+			return nil, err
+		}
+	}
+	desc.Size = int64(len(b))
+	if desc.Digest, err = digest.FromBytes(b); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+func cmdArtifact(args []string) error {
+	fs := flag.NewFlagSet("artifact", flag.ExitOnError)
+	artifactType := fs.String([]string{"-artifact-type"}, "", "Media type describing the artifact")
+	subject := fs.String([]string{"-subject"}, "", "Manifest of the image the artifact refers to")
+	layoutDir := fs.String([]string{"-layout-out"}, "", "Write the blobs and the manifest into a content-addressed blobs/ tree")
+	out := fs.String([]string{"o", "-output"}, "", "Write the manifest to a file instead of stdout")
+	var annotations stringList
+	fs.Var(&annotations, []string{"-annotation"}, "Manifest annotation KEY=VALUE, may be repeated")
+	fs.Parse(args)
+
+	if *artifactType == "" || fs.NArg() == 0 {
+		return errors.New("usage: artifact --artifact-type TYPE [--subject MANIFEST] [--annotation K=V]... FILE[:MEDIATYPE]...")
+	}
+
+	empty := []byte("{}")
+	emptyDigest, _ := digest.FromBytes(empty)
+	m := ArtifactManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  *artifactType,
+		Config:        LayoutDescriptor{MediaType: ociEmptyMediaType, Digest: emptyDigest, Size: int64(len(empty))},
+	}
+
+	for _, a := range annotations {
+		i := strings.Index(a, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid annotation %q, expected KEY=VALUE", a)
+		}
+		if m.Annotations == nil {
+			m.Annotations = map[string]string{}
+		}
+		m.Annotations[a[:i]] = a[i+1:]
+	}
+
+	if *subject != "" {
+		var err error
+		if m.Subject, err = subjectDescriptor(*subject); err != nil {
+			return err
+		}
+	}
+
+	blobs := map[digest.Digest][]byte{emptyDigest: empty}
+	for _, arg := range fs.Args() {
+		fn, mediaType := arg, "application/octet-stream"
+		if i := strings.LastIndex(arg, ":"); i > 0 && strings.Contains(arg[i:], "/") {
+			fn, mediaType = arg[:i], arg[i+1:]
+		}
+
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		d, err := digest.FromBytes(b)
+		if err != nil {
+			return err
+		}
+		blobs[d] = b
+		m.Layers = append(m.Layers, LayoutDescriptor{
+			MediaType:   mediaType,
+			Digest:      d,
+			Size:        int64(len(b)),
+			Annotations: map[string]string{titleAnnotation: filepath.Base(fn)},
+		})
+	}
+
+	x, err := marshalDocument(m)
+	if err != nil {
+		return err
+	}
+	dgst, err := digest.FromBytes(x)
+	if err != nil {
+		return err
+	}
+
+	if *layoutDir != "" {
+		if err := os.MkdirAll(filepath.Join(*layoutDir, "blobs", string(digest.Canonical)), 0755); err != nil {
+			return err
+		}
+		blobs[dgst] = x
+		for d, b := range blobs {
+			if err := writeFileAtomic(blobPath(*layoutDir, d), b, 0644); err != nil {
+				return err
+			}
+		}
+		desc := LayoutDescriptor{MediaType: ociManifestMediaType, Digest: dgst, Size: int64(len(x))}
+		if err := addToLayoutIndex(*layoutDir, desc, *artifactType); err != nil {
+			return fmt.Errorf("error writing layout: %s", err.Error())
+		}
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "artifact manifest digest: %s\n", dgst)
+	}
+
+	if *out != "" {
+		return writeFileAtomic(*out, append(x, '\n'), 0644)
+	}
+	_, err = os.Stdout.Write(append(x, '\n'))
+	return err
+}
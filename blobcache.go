@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CachedBlobSum is what the blob sum cache remembers about a layer.tar
+type CachedBlobSum struct {
+	BlobSum digest.Digest   `json:"blobSum"`
+	Empty   bool            `json:"empty"`
+	Digests []digest.Digest `json:"digests,omitempty"`
+}
+
+// blobCacheKey identifies a layer.tar by its id, size and mtime, and the
+// compression and digest algorithm used since they change the digest
+func blobCacheKey(id string, hdr *tar.Header) string {
+	mode := "gzip"
+	if diff_ids {
+		mode = "raw"
+	} else if compress_threads > 1 {
+		mode = "pgzip"
+	}
+	d, _ := digest.FromBytes([]byte(fmt.Sprintf("%s %d %d %s %s", id, hdr.Size, hdr.ModTime.UnixNano(), mode, digest_algorithm)))
+	return d.Hex()
+}
+
+// lookupBlobSum returns the cached blob sum for key, with --layout-out only
+// when the blob is already in the layout and with --digest-report only
+// when the report digests were cached along with it
+func lookupBlobSum(key string) (*CachedBlobSum, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(blob_cache, key))
+	if err != nil {
+		return nil, false
+	}
+	var c CachedBlobSum
+	if err := json.Unmarshal(b, &c); err != nil || c.BlobSum.Validate() != nil {
+		return nil, false
+	}
+	for _, d := range c.Digests {
+		if d.Validate() != nil {
+			return nil, false
+		}
+	}
+	if layout_out != "" {
+		if _, err := os.Stat(blobPath(layout_out, c.BlobSum)); err != nil {
+			return nil, false
+		}
+	}
+	if digest_report != "" {
+		if _, ok := reportedDigests(c.BlobSum, c.Digests); !ok {
+			return nil, false
+		}
+		addBlobDigests(c.BlobSum, c.Digests)
+	}
+	return &c, true
+}
+
+func storeBlobSum(key string, sum digest.Digest, empty bool, digests []digest.Digest) error {
+	if err := os.MkdirAll(blob_cache, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(CachedBlobSum{BlobSum: sum, Empty: empty, Digests: digests})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(blob_cache, key), b, 0644)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	trust "github.com/docker/libtrust"
+)
+
+// loadCertChain reads a PEM bundle starting with the signer's certificate,
+// the leaf has to belong to the signing key. libtrust sorts signatures by
+// the key ID of their JWK header, which x5c signatures lack, so a chain can
+// only accompany a single signature
+func loadCertChain(fn string, pkeys []trust.PrivateKey) ([]*x509.Certificate, error) {
+	if len(pkeys) != 1 {
+		return nil, errors.New("a certificate chain requires exactly one signing key")
+	}
+
+	chain, err := trust.LoadCertificateBundle(fn)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	if !chainMatches(chain, pkeys[0]) {
+		return nil, errors.New("leaf certificate does not match the signing key")
+	}
+	return chain, nil
+}
+
+func chainMatches(chain []*x509.Certificate, pkey trust.PrivateKey) bool {
+	if len(chain) == 0 {
+		return false
+	}
+	pub, err := trust.FromCryptoPublicKey(chain[0].PublicKey)
+	return err == nil && pub.KeyID() == pkey.KeyID()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type Command struct {
+	Name, Description string
+	Run               func(args []string) error
+}
+
+var commands = []*Command{
+	{"artifact", "Generate an OCI artifact manifest for arbitrary files", cmdArtifact},
+	{"countersign", "Add a signature to an already signed manifest", cmdCountersign},
+	{"edit", "Apply structured edits to a manifest, dropping or renewing signatures", cmdEdit},
+	{"fixture", "Generate docker-save tarballs for testing", cmdFixture},
+	{"genkey", "Generate a private key usable with --key-file", cmdGenkey},
+	{"lint", "Check manifests against the schema1, schema2 and OCI rules before pushing", cmdLint},
+	{"log", "Verify the hash chain of a --log file", cmdLog},
+	{"media-types", "List supported media types and valid combinations as JSON", cmdMediaTypes},
+	{"package-manifest", "Bundle a signed manifest with its signatures and metadata", cmdPackageManifest},
+	{"proxy", "Run a read-only registry proxy verifying manifests and blobs", cmdProxy},
+	{"rebase", "Swap the base layers of an image for those of another image", cmdRebase},
+	{"salvage", "Recover intact layers and metadata from a damaged tarball", cmdSalvage},
+	{"strip-signatures", "Output the unsigned payload of a signed manifest", cmdStripSignatures},
+	{"unpackage", "Verify a manifest package and optionally extract the manifest", cmdUnpackage},
+	{"validate", "Check the structure of tarballs without generating manifests", cmdValidate},
+	{"verify", "Check a tarball against an existing manifest", cmdVerify},
+	{"verify-signature", "Verify the JWS signatures of a signed manifest", cmdVerifySignature},
+}
+
+func findCommand(name string) *Command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func printCommands() {
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", c.Name, c.Description)
+	}
+}
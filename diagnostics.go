@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// exit status used when an image's layer chain cannot be reconstructed
+const exitBrokenChain = 3
+
+// chainError describes why the layer chain of an image could not be
+// assembled, along with everything seen in the archive to help tracking
+// down the cause
+type chainError struct {
+	Problem string
+	Walked  []string
+	Layers  LayerMap
+}
+
+func (e *chainError) Error() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "broken layer chain: %s", e.Problem)
+	fmt.Fprintf(&b, "\n    chain walked: %s", strings.Join(e.Walked, " -> "))
+
+	ids := make([]string, 0, len(e.Layers))
+	for id := range e.Layers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	fmt.Fprintf(&b, "\n    layers in archive (id <- parent):")
+	for _, id := range ids {
+		l := e.Layers[id]
+		parent := l.Parent
+		if l.Data == "" {
+			parent = "? (no json)"
+		} else if parent == "" {
+			parent = "(none)"
+		}
+		missing := ""
+		if l.BlobSum == "" {
+			missing = " [no layer.tar]"
+		}
+		fmt.Fprintf(&b, "\n      %s <- %s%s", id, parent, missing)
+	}
+
+	fmt.Fprintf(&b, "\n    likely causes: the tarball is truncated or was saved from a pruned or partially"+
+		"\n    pulled image, or layers were removed from it; re-run `docker save` for the image or"+
+		"\n    check the archive with `docker-manifest salvage`")
+	return b.String()
+}
+
+func short(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func newChainError(problem string, walked []string, layers LayerMap) *chainError {
+	w := make([]string, len(walked))
+	for i, id := range walked {
+		w[i] = short(id)
+	}
+	return &chainError{Problem: problem, Walked: w, Layers: layers}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/docker/distribution/digest"
+)
+
+// DiffIDs lists the digests of the uncompressed layers of an image from
+// the bottom up, in the form of the rootfs of an image config
+type DiffIDs struct {
+	Name   string `json:"name"`
+	Tag    string `json:"tag"`
+	RootFS struct {
+		Type    string          `json:"type"`
+		DiffIDs []digest.Digest `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// generateDiffIDs is the --diff-ids counterpart of generateManifest, the
+// blob sums of layers are digests of their uncompressed tar in that mode
+func generateDiffIDs(ref *ImageRef, layers LayerMap) ([]byte, error) {
+	chain, err := getLayerChain(ref.TopId, layers)
+	if err != nil {
+		return nil, err
+	}
+
+	d := DiffIDs{Name: ref.Repo, Tag: ref.Tag}
+	d.RootFS.Type = "layers"
+	for i := len(chain) - 1; i >= 0; i-- {
+		d.RootFS.DiffIDs = append(d.RootFS.DiffIDs, chain[i].BlobSum)
+	}
+	return marshalDocument(d)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docker/distribution/digest"
+)
+
+var (
+	// what registries verify blob references with
+	registryAlgorithms = map[digest.Algorithm]bool{
+		digest.SHA256: true,
+		digest.SHA384: true,
+		digest.SHA512: true,
+	}
+	// the OCI image spec registers fewer
+	ociAlgorithms = map[digest.Algorithm]bool{
+		digest.SHA256: true,
+		digest.SHA512: true,
+	}
+)
+
+// checkDigestAlgorithm makes sure the outputs asked for can reference layers
+// by digest_algorithm. Manifests themselves are always addressed by sha256,
+// that's the only digest registries serve them under.
+func checkDigestAlgorithm() error {
+	switch {
+	case !registryAlgorithms[digest_algorithm]:
+		return fmt.Errorf("unsupported algorithm %q, use sha256, sha384 or sha512", digest_algorithm)
+	case !digest_algorithm.Available():
+		return fmt.Errorf("%s is not available in this build", digest_algorithm)
+	case layout_out != "" && !ociAlgorithms[digest_algorithm]:
+		return fmt.Errorf("OCI layouts only allow sha256 and sha512, not %s", digest_algorithm)
+	}
+	return nil
+}
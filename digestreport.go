@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"io"
+	"sync"
+)
+
+// DigestReport is written with --digest-report and lists every layer of
+// the emitted images digested with several algorithms, for consumers that
+// need other digests than the blob sums in the manifests
+type DigestReport struct {
+	Algorithms []digest.Algorithm  `json:"algorithms"`
+	Images     []DigestReportImage `json:"images"`
+}
+
+type DigestReportImage struct {
+	Name   string              `json:"name"`
+	Tag    string              `json:"tag"`
+	Layers []DigestReportLayer `json:"layers"`
+}
+
+// DigestReportLayer describes the blob the manifest refers to, layers are
+// listed top first like fsLayers
+type DigestReportLayer struct {
+	Id      string            `json:"id"`
+	BlobSum digest.Digest     `json:"blobSum"`
+	Digests map[string]string `json:"digests"`
+}
+
+var (
+	// report_algorithms adds to these
+	defaultReportAlgorithms = []digest.Algorithm{digest.SHA256, digest.SHA512}
+
+	// the report digests of every blob summed, by blob sum
+	blobDigests   = map[digest.Digest][]digest.Digest{}
+	blobDigestsMu sync.Mutex
+
+	digestReport = &DigestReport{}
+)
+
+// reportAlgorithms returns the algorithms of the report, an error names the
+// first one that cannot be computed
+func reportAlgorithms() ([]digest.Algorithm, error) {
+	algs := append([]digest.Algorithm{}, defaultReportAlgorithms...)
+	for _, s := range report_algorithms {
+		alg := digest.Algorithm(s)
+		if !alg.Available() {
+			return nil, fmt.Errorf("unsupported algorithm %q", s)
+		}
+		if !hasAlgorithm(algs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	return algs, nil
+}
+
+func hasAlgorithm(algs []digest.Algorithm, alg digest.Algorithm) bool {
+	for _, a := range algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// newLayerDigester hashes a blob with digest_algorithm first and, with
+// --digest-report, the report algorithms after it
+func newLayerDigester() multiDigester {
+	md := multiDigester{digest_algorithm.New()}
+	if digest_report == "" {
+		return md
+	}
+	for _, alg := range digestReport.Algorithms {
+		if alg != digest_algorithm {
+			md = append(md, alg.New())
+		}
+	}
+	return md
+}
+
+// recordDigests remembers the digests of a blob for the report and returns
+// its blob sum
+func recordDigests(md multiDigester) digest.Digest {
+	ds := md.Digests()
+	if len(ds) > 1 {
+		addBlobDigests(ds[0], ds)
+	}
+	return ds[0]
+}
+
+func addBlobDigests(sum digest.Digest, ds []digest.Digest) {
+	blobDigestsMu.Lock()
+	blobDigests[sum] = ds
+	blobDigestsMu.Unlock()
+}
+
+// reportedDigests returns what is known of sum in the report algorithms,
+// ok is false when one of them is missing
+func reportedDigests(sum digest.Digest, ds []digest.Digest) (map[string]string, bool) {
+	m := map[string]string{}
+	for _, d := range append(ds, sum) {
+		if hasAlgorithm(digestReport.Algorithms, d.Algorithm()) {
+			m[string(d.Algorithm())] = d.Hex()
+		}
+	}
+	return m, len(m) == len(digestReport.Algorithms)
+}
+
+// digestLayer digests r as a whole, like blobSumLayer without compressing
+func digestLayer(r io.Reader) (digest.Digest, error) {
+	md := newLayerDigester()
+	if _, err := io.Copy(md, r); err != nil {
+		return "", err
+	}
+	return recordDigests(md), nil
+}
+
+// addToReport lists the layers ref was emitted with
+func addToReport(ref *ImageRef, layers LayerMap) error {
+	chain, skip, err := imageLayers(ref, layers)
+	if err != nil {
+		return err
+	}
+	if !diff_ids {
+		chain = chain[:len(chain)-skip]
+	}
+
+	img := DigestReportImage{Name: ref.Repo, Tag: ref.Tag}
+	blobDigestsMu.Lock()
+	defer blobDigestsMu.Unlock()
+	for _, l := range chain {
+		ds, ok := reportedDigests(l.BlobSum, blobDigests[l.BlobSum])
+		if !ok {
+			return fmt.Errorf("layer %s was not digested with all of %v", l.Id, digestReport.Algorithms)
+		}
+		img.Layers = append(img.Layers, DigestReportLayer{Id: l.Id, BlobSum: l.BlobSum, Digests: ds})
+	}
+	digestReport.Images = append(digestReport.Images, img)
+	return nil
+}
+
+func writeDigestReport(fn string) error {
+	b, err := marshalDocument(digestReport)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, append(b, '\n'), 0644)
+}
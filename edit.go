@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	flag "github.com/docker/docker/pkg/mflag"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is either an object key or, with key empty, an array index
+type pathSegment struct {
+	key   string
+	index int
+}
+
+// parsePath splits paths like history[3].v1Compatibility into segments
+func parsePath(p string) ([]pathSegment, error) {
+	var segs []pathSegment
+	for _, part := range strings.Split(p, ".") {
+		key := part
+		var idx []string
+		if i := strings.Index(part, "["); i >= 0 {
+			key = part[:i]
+			for _, s := range strings.Split(part[i+1:], "[") {
+				if !strings.HasSuffix(s, "]") {
+					return nil, fmt.Errorf("invalid path %q", p)
+				}
+				idx = append(idx, strings.TrimSuffix(s, "]"))
+			}
+		}
+		if key == "" {
+			return nil, fmt.Errorf("invalid path %q", p)
+		}
+		segs = append(segs, pathSegment{key: key})
+		for _, s := range idx {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid index %q in path %q", s, p)
+			}
+			segs = append(segs, pathSegment{index: n})
+		}
+	}
+	return segs, nil
+}
+
+// editPath walks to the parent of the last segment and hands it to fn,
+// which returns the replacement for the parent
+func editPath(v interface{}, segs []pathSegment, fn func(parent interface{}, last pathSegment) (interface{}, error)) (interface{}, error) {
+	if len(segs) == 1 {
+		return fn(v, segs[0])
+	}
+
+	s := segs[0]
+	if s.key != "" {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: not an object", s.key)
+		}
+		child, ok := obj[s.key]
+		if !ok {
+			return nil, fmt.Errorf("%s: no such field", s.key)
+		}
+		n, err := editPath(child, segs[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		obj[s.key] = n
+		return obj, nil
+	}
+
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("[%d]: not an array", s.index)
+	}
+	if s.index >= len(arr) {
+		return nil, fmt.Errorf("[%d]: index out of range", s.index)
+	}
+	n, err := editPath(arr[s.index], segs[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	arr[s.index] = n
+	return arr, nil
+}
+
+func setPath(v interface{}, segs []pathSegment, value interface{}) (interface{}, error) {
+	return editPath(v, segs, func(parent interface{}, last pathSegment) (interface{}, error) {
+		if last.key != "" {
+			obj, ok := parent.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: parent is not an object", last.key)
+			}
+			obj[last.key] = value
+			return obj, nil
+		}
+		arr, ok := parent.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("[%d]: parent is not an array", last.index)
+		}
+		if last.index > len(arr) {
+			return nil, fmt.Errorf("[%d]: index out of range", last.index)
+		} else if last.index == len(arr) {
+			return append(arr, value), nil
+		}
+		arr[last.index] = value
+		return arr, nil
+	})
+}
+
+func removePath(v interface{}, segs []pathSegment) (interface{}, error) {
+	return editPath(v, segs, func(parent interface{}, last pathSegment) (interface{}, error) {
+		if last.key != "" {
+			obj, ok := parent.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: parent is not an object", last.key)
+			}
+			if _, ok := obj[last.key]; !ok {
+				return nil, fmt.Errorf("%s: no such field", last.key)
+			}
+			delete(obj, last.key)
+			return obj, nil
+		}
+		arr, ok := parent.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("[%d]: parent is not an array", last.index)
+		}
+		if last.index >= len(arr) {
+			return nil, fmt.Errorf("[%d]: index out of range", last.index)
+		}
+		return append(arr[:last.index], arr[last.index+1:]...), nil
+	})
+}
+
+// pairedPath returns the entry of the other list when p addresses a whole
+// fsLayers or history entry, the two lists describe the same layers
+func pairedPath(segs []pathSegment) []pathSegment {
+	if len(segs) != 2 || segs[1].key != "" {
+		return nil
+	}
+	switch segs[0].key {
+	case "fsLayers":
+		return []pathSegment{{key: "history"}, segs[1]}
+	case "history":
+		return []pathSegment{{key: "fsLayers"}, segs[1]}
+	}
+	return nil
+}
+
+func cmdEdit(args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	var sets, removes, keyFiles stringList
+	fs.Var(&sets, []string{"-set"}, "Set PATH=VALUE, VALUE is parsed as JSON and taken as a string otherwise")
+	fs.Var(&removes, []string{"-remove"}, "Remove PATH, removing a history or fsLayers entry removes its counterpart too")
+	fs.Var(&keyFiles, []string{"k", "-key-file"}, "Private key or directory of keys with which to re-sign the manifest")
+	out := fs.String([]string{"o", "-output"}, "", "Write the manifest to a file instead of stdout")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || len(sets)+len(removes) == 0 {
+		return errors.New("usage: edit [--set PATH=VALUE]... [--remove PATH]... [-k KEY] MANIFEST")
+	}
+
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	signed := false
+	if jsig, err := trust.ParsePrettySignature(b, "signatures"); err == nil {
+		if b, err = jsig.Payload(); err != nil {
+			return err
+		}
+		signed = true
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("error parsing manifest: %s", err.Error())
+	}
+
+	for _, s := range sets {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid --set %q, expected PATH=VALUE", s)
+		}
+		segs, err := parsePath(s[:i])
+		if err != nil {
+			return err
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(s[i+1:]), &value); err != nil {
+			value = s[i+1:]
+		}
+		if doc, err = setPath(doc, segs, value); err != nil {
+			return fmt.Errorf("error setting %s: %s", s[:i], err.Error())
+		}
+	}
+
+	for _, r := range removes {
+		segs, err := parsePath(r)
+		if err != nil {
+			return err
+		}
+		if doc, err = removePath(doc, segs); err != nil {
+			return fmt.Errorf("error removing %s: %s", r, err.Error())
+		}
+		if p := pairedPath(segs); p != nil {
+			if doc, err = removePath(doc, p); err != nil {
+				return fmt.Errorf("error removing %s: %s", r, err.Error())
+			}
+		}
+	}
+
+	// round trip through the schema to reject unknown fields and restore
+	// the field order and indentation generated manifests have
+	if b, err = json.Marshal(doc); err != nil {
+		return err
+	}
+	var m manifest.Manifest
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return fmt.Errorf("edited manifest is invalid: %s", err.Error())
+	}
+	if len(m.FSLayers) != len(m.History) {
+		return fmt.Errorf("edited manifest is invalid: %d fsLayers but %d history entries", len(m.FSLayers), len(m.History))
+	}
+
+	x, err := marshalDocument(m)
+	if err != nil {
+		return err
+	}
+
+	if len(keyFiles) > 0 {
+		pkeys, err := loadKeys(keyFiles)
+		if err != nil {
+			return fmt.Errorf("error loading key: %s", err.Error())
+		}
+		if x, err = signPayload(x, pkeys); err != nil {
+			return err
+		}
+	} else if signed {
+		fmt.Fprintln(os.Stderr, "warning: signatures removed, the edited manifest is unsigned (use -k to re-sign)")
+	}
+
+	if *out != "" {
+		return writeFileAtomic(*out, append(x, '\n'), 0644)
+	}
+	_, err = os.Stdout.Write(append(x, '\n'))
+	return err
+}
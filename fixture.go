@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	flag "github.com/docker/docker/pkg/mflag"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func cmdFixture(args []string) error {
+	if len(args) == 0 || args[0] != "generate" {
+		return errors.New("usage: fixture generate [OPTIONS]")
+	}
+
+	var tags stringList
+	fs := flag.NewFlagSet("fixture generate", flag.ExitOnError)
+	layers := fs.Int([]string{"-layers"}, 3, "Number of layers")
+	size := fs.String([]string{"-size"}, "1MB", "Size of the content of each layer")
+	repo := fs.String([]string{"-name"}, "fixture", "Repository name")
+	fs.Var(&tags, []string{"-tag"}, "Tag of the image, may be repeated (default latest)")
+	broken := fs.Bool([]string{"-broken-chain"}, false, "Leave out the root layer so the parent chain is incomplete")
+	seed := fs.Int64([]string{"-seed"}, 1, "Seed for the generated layer content")
+	out := fs.String([]string{"o", "-output"}, "", "Write the tarball to a file instead of stdout")
+	fs.Parse(args[1:])
+
+	if *layers < 1 {
+		return errors.New("--layers must be at least 1")
+	}
+	n, err := parseSize(*size)
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		tags = stringList{"latest"}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeFixture(bw, *repo, tags, *layers, n, *broken, *seed); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSuffix(s, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+func writeFixture(w io.Writer, repo string, tags []string, layers int, size int64, broken bool, seed int64) error {
+	tw := tar.NewWriter(w)
+	rnd := rand.New(rand.NewSource(seed))
+	created := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ids := make([]string, layers)
+	for i := range ids {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", repo, seed, i)))
+		ids[i] = hex.EncodeToString(h[:])
+	}
+
+	for i, id := range ids {
+		if broken && i == 0 {
+			continue
+		}
+
+		img := map[string]interface{}{
+			"id":           id,
+			"created":      created.Add(time.Duration(i) * time.Minute),
+			"architecture": "amd64",
+			"os":           "linux",
+			"Size":         size,
+		}
+		if i > 0 {
+			img["parent"] = ids[i-1]
+		}
+		data, err := json.Marshal(img)
+		if err != nil {
+			return err
+		}
+
+		// the framing of the layer tar doesn't depend on its content, so a
+		// dry run over zeros gives its size and the layer itself is streamed
+		name := fmt.Sprintf("layer-%d.bin", i)
+		n := &countingWriter{}
+		if err := writeLayerTar(n, name, io.LimitReader(zeros{}, size), size, created); err != nil {
+			return err
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeLayerTar(pw, name, io.LimitReader(rnd, size), size, created))
+		}()
+
+		if err := writeTarFile(tw, id+"/VERSION", strings.NewReader("1.0"), 3, created); err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, id+"/json", bytes.NewReader(data), int64(len(data)), created); err != nil {
+			return err
+		}
+		err = writeTarFile(tw, id+"/layer.tar", pr, n.n, created)
+		// unblocks the writer should the copy have stopped early
+		pr.CloseWithError(err)
+		if err != nil {
+			return err
+		}
+	}
+
+	repos := map[string]map[string]string{repo: {}}
+	for _, t := range tags {
+		repos[repo][t] = ids[len(ids)-1]
+	}
+	data, err := json.Marshal(repos)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "repositories", bytes.NewReader(data), int64(len(data)), created); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// zeros reads as an endless run of zero bytes
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// writeLayerTar writes a layer tar holding a single file
+func writeLayerTar(w io.Writer, name string, r io.Reader, size int64, mtime time.Time) error {
+	lw := tar.NewWriter(w)
+	if err := writeTarFile(lw, name, r, size, mtime); err != nil {
+		return err
+	}
+	return lw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, r io.Reader, size int64, mtime time.Time) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  mtime,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
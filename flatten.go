@@ -0,0 +1,220 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// openLayerTar positions a reader at the layer.tar of id, decompressing it
+// when stored gzipped; the archive is read without buffering so tar skips
+// the data of other entries by seeking
+func openLayerTar(f *os.File, id string) (*tar.Reader, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	t := tar.NewReader(f)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("layer.tar of %s not found", id)
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Base(hdr.Name) != "layer.tar" || getLayerPrefix(hdr.Name) != id {
+			continue
+		}
+		br := bufio.NewReader(t)
+		if !isGzip(br) {
+			return tar.NewReader(br), nil
+		}
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(gr), nil
+	}
+}
+
+// hidden reports whether p or one of its parents was removed or replaced
+// by an upper layer
+func hidden(p string, gone map[string]bool) bool {
+	for ; p != "." && p != "/"; p = path.Dir(p) {
+		if gone[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleEntries walks chain from the top and works out which entries of
+// every layer end up in the final filesystem, honouring whiteouts
+func visibleEntries(f *os.File, chain []*Layer) ([]map[string]bool, error) {
+	keep := make([]map[string]bool, len(chain))
+	seen := map[string]bool{}
+	gone := map[string]bool{}
+	for i, l := range chain {
+		t, err := openLayerTar(f, l.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		keep[i] = map[string]bool{}
+		// whiteouts and replaced files only hide what the layers below have
+		var hides []string
+		for {
+			hdr, err := t.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("error reading layer %s: %s", l.Id, err.Error())
+			}
+
+			p := path.Clean(hdr.Name)
+			base := path.Base(p)
+			switch {
+			case base == whiteoutOpaque:
+				hides = append(hides, path.Dir(p))
+			case strings.HasPrefix(base, whiteoutPrefix):
+				hides = append(hides, path.Join(path.Dir(p), strings.TrimPrefix(base, whiteoutPrefix)))
+			case seen[p] || hidden(p, gone):
+				// shadowed by an upper layer
+			default:
+				seen[p], keep[i][p] = true, true
+				if hdr.Typeflag != tar.TypeDir {
+					hides = append(hides, p)
+				}
+			}
+		}
+		for _, p := range hides {
+			gone[p] = true
+		}
+	}
+
+	return keep, nil
+}
+
+// writeFlattened writes a single tar holding the final filesystem of chain,
+// the base layer's entries come first so parents precede their children
+func writeFlattened(target string, chain []*Layer, w io.Writer) error {
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keep, err := visibleEntries(f, chain)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for i := len(chain) - 1; i >= 0; i-- {
+		t, err := openLayerTar(f, chain[i].Id)
+		if err != nil {
+			return err
+		}
+		for {
+			hdr, err := t.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("error reading layer %s: %s", chain[i].Id, err.Error())
+			}
+			if !keep[i][path.Clean(hdr.Name)] {
+				continue
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, t); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// flattenImage replaces the layer chain of ref by a single layer holding
+// its final filesystem, the history entry is the top layer's without a
+// parent and the new layer is added to layers
+func flattenImage(target string, ref *ImageRef, layers LayerMap) error {
+	chain, err := getLayerChain(ref.TopId, layers)
+	if err != nil {
+		return err
+	}
+	top := chain[0]
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeFlattened(target, chain, pw))
+	}()
+
+	z, size := &zeroWriter{}, &countingWriter{}
+	r := io.TeeReader(pr, io.MultiWriter(z, size))
+	sum, err := sumLayer(r)
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("error flattening %s:%s: %s", ref.Repo, ref.Tag, err.Error())
+	}
+
+	// derive the id from what the layer is made of, so flattening the same
+	// image twice yields the same manifest
+	d, err := digest.FromBytes([]byte(top.Data + string(sum)))
+	if err != nil {
+		return err
+	}
+	id := d.Hex()
+
+	o, err := parseObject([]byte(top.Data))
+	if err != nil {
+		return err
+	}
+	idb, _ := json.Marshal(id)
+	o.Set("id", idb)
+	o.Delete("parent")
+	o.Delete("throwaway")
+	o.Set("Size", json.RawMessage(strconv.FormatInt(size.n, 10)))
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "flattened %d layers of %s:%s into %s\n", len(chain), ref.Repo, ref.Tag, id)
+	}
+
+	layers[id] = &Layer{
+		Id:           id,
+		Architecture: top.Architecture,
+		OS:           top.OS,
+		BlobSum:      sum,
+		Data:         string(b) + "\n",
+		Empty:        !z.nonzero,
+	}
+	ref.TopId = id
+	return nil
+}
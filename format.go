@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/docker/distribution/digest"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	"io"
+	"strings"
+	"text/template"
+)
+
+type FormatData struct {
+	manifest.Manifest
+	Digest digest.Digest
+}
+
+var formatFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+}
+
+func parseFormat(f string) (*template.Template, error) {
+	return template.New("format").Funcs(formatFuncs).Parse(f)
+}
+
+func formatManifest(w io.Writer, tmpl *template.Template, x []byte, dgst digest.Digest) error {
+	data := FormatData{Digest: dgst}
+	if err := json.Unmarshal(x, &data.Manifest); err != nil {
+		return err
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	flag "github.com/docker/docker/pkg/mflag"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var keyGenerators = map[string]func() (trust.PrivateKey, error){
+	"ec-p256":  trust.GenerateECP256PrivateKey,
+	"ec-p384":  trust.GenerateECP384PrivateKey,
+	"ec-p521":  trust.GenerateECP521PrivateKey,
+	"rsa-2048": trust.GenerateRSA2048PrivateKey,
+	"rsa-3072": trust.GenerateRSA3072PrivateKey,
+	"rsa-4096": trust.GenerateRSA4096PrivateKey,
+}
+
+func cmdGenkey(args []string) error {
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	keyType := fs.String([]string{"-type"}, "ec-p256", "Key type: ec-p256, ec-p384, ec-p521, rsa-2048, rsa-3072 or rsa-4096")
+	force := fs.Bool([]string{"f", "-force"}, false, "Overwrite an existing key file")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: genkey [--type TYPE] FILE (.json/.jwk for JWK, PEM otherwise)")
+	}
+	fn := fs.Arg(0)
+
+	gen, ok := keyGenerators[*keyType]
+	if !ok {
+		return fmt.Errorf("unknown key type %q", *keyType)
+	}
+
+	if _, err := os.Stat(fn); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", fn)
+	}
+
+	pk, err := gen()
+	if err != nil {
+		return fmt.Errorf("error generating private key: %s", err.Error())
+	}
+	// SaveKey only applies its 0600 mode to new files, so the key is saved
+	// into a private directory and moved over any existing file
+	dir, err := ioutil.TempDir(filepath.Dir(fn), ".docker-manifest-key-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, filepath.Base(fn))
+	if err := trust.SaveKey(tmp, pk); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		return err
+	}
+
+	fmt.Println(pk.KeyID())
+	return nil
+}
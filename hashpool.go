@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/docker/distribution/digest"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// layerSum is the outcome of compressing and hashing one spooled layer
+type layerSum struct {
+	id    string
+	sum   digest.Digest
+	empty bool
+	err   error
+}
+
+type spooledLayer struct {
+	id, fn string
+}
+
+// hashPool computes blob sums on several cores, the tar stream has to be
+// read in order so layers are spooled to temporary files and handed to the
+// workers, which bounds the disk used to a file per worker plus one
+type hashPool struct {
+	queue   chan spooledLayer
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	results []layerSum
+	once    sync.Once
+}
+
+func newHashPool(workers int) *hashPool {
+	p := &hashPool{queue: make(chan spooledLayer)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for s := range p.queue {
+				r := sumSpooled(s)
+				p.mu.Lock()
+				p.results = append(p.results, r)
+				p.mu.Unlock()
+			}
+		}()
+	}
+	return p
+}
+
+// spool copies r to a temporary file and queues it, blocking until a
+// worker is free
+func (p *hashPool) spool(id string, r io.Reader) error {
+	f, err := ioutil.TempFile("", ".docker-manifest-layer-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	p.queue <- spooledLayer{id: id, fn: f.Name()}
+	return nil
+}
+
+// wait lets the workers finish and returns their results, it may be
+// called more than once
+func (p *hashPool) wait() []layerSum {
+	p.once.Do(func() {
+		close(p.queue)
+		p.wg.Wait()
+	})
+	return p.results
+}
+
+func sumSpooled(s spooledLayer) layerSum {
+	defer os.Remove(s.fn)
+	f, err := os.Open(s.fn)
+	if err != nil {
+		return layerSum{id: s.id, err: err}
+	}
+	defer f.Close()
+
+	z := &zeroWriter{}
+	r := io.TeeReader(f, z)
+	sum, err := sumLayer(r)
+	return layerSum{id: s.id, sum: sum, empty: !z.nonzero, err: err}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+var nonEssentialFields = []string{"container_config", "container", "docker_version", "author", "comment"}
+
+// stripFields drops the given top-level keys from a v1Compatibility entry
+func stripFields(data string, keys ...string) (string, error) {
+	o, err := parseObject([]byte(data))
+	if err != nil {
+		return "", err
+	}
+	for _, k := range keys {
+		o.Delete(k)
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+func trimHistory(data string) (string, error) {
+	return stripFields(data, nonEssentialFields...)
+}
+
+// truncateCmd shortens every argument of container_config.Cmd, the
+// command of the build step, to at most max bytes
+func truncateCmd(data string, max int) (string, error) {
+	o, err := parseObject([]byte(data))
+	if err != nil {
+		return "", err
+	}
+	raw, ok := o.Get("container_config")
+	if !ok || string(raw) == "null" {
+		return data, nil
+	}
+	cc, err := parseObject(raw)
+	if err != nil {
+		return "", err
+	}
+	rawCmd, ok := cc.Get("Cmd")
+	if !ok || string(rawCmd) == "null" {
+		return data, nil
+	}
+
+	var cmd []string
+	if err := json.Unmarshal(rawCmd, &cmd); err != nil {
+		return "", err
+	}
+	changed := false
+	for i, arg := range cmd {
+		if len(arg) > max {
+			// don't cut a multi-byte character in half
+			n := max
+			for n > 0 && !utf8.RuneStart(arg[n]) {
+				n--
+			}
+			cmd[i] = arg[:n] + "..."
+			changed = true
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+	cc.Set("Cmd", b)
+	if b, err = json.Marshal(cc); err != nil {
+		return "", err
+	}
+	o.Set("container_config", b)
+	if b, err = json.Marshal(o); err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+func checkHistorySize(layers []*Layer, history []string, max int) error {
+	if max <= 0 {
+		return nil
+	}
+
+	oversized := []string{}
+	for i, h := range history {
+		if len(h) > max {
+			oversized = append(oversized, fmt.Sprintf("%s (%d bytes)", layers[i].Id, len(h)))
+		}
+	}
+	if len(oversized) == 0 {
+		return nil
+	}
+
+	hint := ""
+	if !trim_history {
+		hint = ", try --strip-container-config, --truncate-cmd or --trim-history-fields"
+	}
+	return fmt.Errorf("history of %d layer(s) exceeds %d bytes%s: %s", len(oversized), max, hint, strings.Join(oversized, ", "))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type HookEvent struct {
+	Stage  string        `json:"stage"`
+	Phase  string        `json:"phase"`
+	Name   string        `json:"name"`
+	Tag    string        `json:"tag"`
+	Digest digest.Digest `json:"digest,omitempty"`
+	KeyIds []string      `json:"keyIds,omitempty"`
+}
+
+func runHooks(hooks []string, stage, phase string, ev *HookEvent) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	ev.Stage, ev.Phase = stage, phase
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hooks {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "running %s-%s hook: %s\n", phase, stage, h)
+		}
+
+		if strings.HasPrefix(h, "http://") || strings.HasPrefix(h, "https://") {
+			err = postHook(h, b)
+		} else {
+			err = execHook(h, b, ev)
+		}
+		if err != nil {
+			return fmt.Errorf("%s-%s hook %q failed: %s", phase, stage, h, err.Error())
+		}
+	}
+	return nil
+}
+
+// httpClient gives up after --http-timeout, the default client waits forever
+func httpClient() *http.Client {
+	return &http.Client{Timeout: http_timeout}
+}
+
+func postHook(url string, b []byte) error {
+	resp, err := httpClient().Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func execHook(command string, b []byte, ev *HookEvent) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"DOCKER_MANIFEST_STAGE="+ev.Stage,
+		"DOCKER_MANIFEST_PHASE="+ev.Phase,
+		"DOCKER_MANIFEST_NAME="+ev.Name,
+		"DOCKER_MANIFEST_TAG="+ev.Tag,
+		"DOCKER_MANIFEST_DIGEST="+string(ev.Digest))
+	return cmd.Run()
+}
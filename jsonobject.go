@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// jsonObject is a JSON object that keeps the order of its keys, so the
+// v1Compatibility blobs can be edited without reshuffling them
+type jsonObject []jsonField
+
+type jsonField struct {
+	Key   string
+	Value json.RawMessage
+}
+
+func parseObject(b []byte) (jsonObject, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if d, ok := t.(json.Delim); !ok || d != '{' {
+		return nil, errors.New("not a JSON object")
+	}
+
+	o := jsonObject{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		o = append(o, jsonField{Key: t.(string), Value: v})
+	}
+	return o, nil
+}
+
+func (o jsonObject) Get(key string) (json.RawMessage, bool) {
+	for _, f := range o {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (o *jsonObject) Set(key string, v json.RawMessage) {
+	for i, f := range *o {
+		if f.Key == key {
+			(*o)[i].Value = v
+			return
+		}
+	}
+	*o = append(*o, jsonField{Key: key, Value: v})
+}
+
+func (o *jsonObject) Delete(key string) {
+	for i, f := range *o {
+		if f.Key == key {
+			*o = append((*o)[:i], (*o)[i+1:]...)
+			return
+		}
+	}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		if err := json.Compact(&buf, f.Value); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const acceptedKeyFormats = "accepted formats are libtrust JWK (.json/.jwk), PEM encoded PKCS#1 RSA (RSA PRIVATE KEY), " +
+	"SEC1 EC (EC PRIVATE KEY) or unencrypted PKCS#8 (PRIVATE KEY) keys, and DER encoded PKCS#8, PKCS#1 or SEC1 keys"
+
+func loadKey(fn string) (trust.PrivateKey, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if ext := strings.ToLower(filepath.Ext(fn)); ext == ".json" || ext == ".jwk" || bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		k, err := trust.UnmarshalPrivateKeyJWK(b)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode private key JWK: %s", err.Error())
+		}
+		return k, nil
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		k, err := parseDERKey(b)
+		if err == errNotDERKey {
+			return nil, fmt.Errorf("no PEM data found and not a DER encoded key, %s", acceptedKeyFormats)
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to use DER encoded private key: %s", err.Error())
+		}
+		return k, nil
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY":
+		return trust.UnmarshalPrivateKeyPEM(b)
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode PKCS#8 private key: %s", err.Error())
+		}
+		return fromCryptoKey(k)
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, errors.New("encrypted PKCS#8 keys are not supported, decrypt it first with `openssl pkcs8 -in KEY -out KEY.pem`")
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q, %s", block.Type, acceptedKeyFormats)
+}
+
+// fromCryptoKey wraps RSA and ECDSA keys, the JWS algorithm (RS256, ES256,
+// ES384 or ES512) then follows from the key type and curve. Schema1
+// signatures are verified with libtrust which has no EdDSA support, so
+// Ed25519 keys can't be used to sign
+func fromCryptoKey(k interface{}) (trust.PrivateKey, error) {
+	pk, err := trust.FromCryptoPrivateKey(k)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported key type %T, only RSA and ECDSA P-256/P-384/P-521 keys can sign schema1 manifests", k)
+	}
+	return pk, nil
+}
+
+var errNotDERKey = errors.New("not a DER encoded private key")
+
+// parseDERKey returns errNotDERKey when b is none of the DER key encodings,
+// other errors are about keys that did parse
+func parseDERKey(b []byte) (trust.PrivateKey, error) {
+	if k, err := x509.ParsePKCS8PrivateKey(b); err == nil {
+		return fromCryptoKey(k)
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(b); err == nil {
+		return trust.FromCryptoPrivateKey(k)
+	}
+	if k, err := x509.ParseECPrivateKey(b); err == nil {
+		return trust.FromCryptoPrivateKey(k)
+	}
+	return nil, errNotDERKey
+}
+
+// loadKeys loads every given key file, directories contribute all their
+// key files in lexical order
+func loadKeys(paths []string) ([]trust.PrivateKey, error) {
+	keys := []trust.PrivateKey{}
+	for _, p := range paths {
+		files := []string{p}
+		if fi, err := os.Stat(p); err != nil {
+			return nil, err
+		} else if fi.IsDir() {
+			entries, err := ioutil.ReadDir(p)
+			if err != nil {
+				return nil, err
+			}
+			files = files[:0]
+			for _, e := range entries {
+				switch strings.ToLower(filepath.Ext(e.Name())) {
+				case ".json", ".jwk", ".pem", ".key", ".der", ".p8":
+					if !e.IsDir() {
+						files = append(files, filepath.Join(p, e.Name()))
+					}
+				}
+			}
+			sort.Strings(files)
+		}
+
+		for _, fn := range files {
+			k, err := loadKey(fn)
+			if err != nil {
+				return nil, &os.PathError{Op: "load key", Path: fn, Err: err}
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func keyIds(keys []trust.PrivateKey) []string {
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.KeyID()
+	}
+	return ids
+}
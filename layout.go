@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/docker/distribution/digest"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+type LayoutIndex struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	Manifests     []LayoutDescriptor `json:"manifests"`
+}
+
+type LayoutDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       digest.Digest     `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+func blobPath(dir string, d digest.Digest) string {
+	return filepath.Join(dir, "blobs", string(d.Algorithm()), d.Hex())
+}
+
+func writeLayerBlob(dir string, r io.Reader) (digest.Digest, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", string(digest_algorithm)), 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(dir, "blobs"), ".layer-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	sum, err := blobSumLayer(r, tmp)
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return sum, os.Rename(tmp.Name(), blobPath(dir, sum))
+}
+
+// writeLayout adds manifests to the layout in dir, signed tells whether they
+// were signed with any key, local or in Vault
+func writeLayout(dir string, refs []*ImageRef, manifests [][]byte, signed bool) error {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", string(digest.Canonical)), 0755); err != nil {
+		return err
+	}
+
+	index, err := readLayoutIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	mediaType := manifest.ManifestMediaType
+	if signed {
+		mediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	}
+
+	for i, ref := range refs {
+		// signed manifests go by the digest of their payload, like in a
+		// registry, and are stored whole so the signatures are kept
+		dgst, err := manifestDigest(manifests[i], signed)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(blobPath(dir, dgst), manifests[i], 0644); err != nil {
+			return err
+		}
+
+		desc := LayoutDescriptor{
+			MediaType:   mediaType,
+			Digest:      dgst,
+			Size:        int64(len(manifests[i])),
+			Annotations: map[string]string{refNameAnnotation: ref.Repo + ":" + ref.Tag},
+		}
+
+		replaced := false
+		for j, d := range index.Manifests {
+			if d.Annotations[refNameAnnotation] == desc.Annotations[refNameAnnotation] {
+				index.Manifests[j], replaced = desc, true
+			}
+		}
+		if !replaced {
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+
+	return writeLayoutIndex(dir, index)
+}
+
+func readLayoutIndex(dir string) (*LayoutIndex, error) {
+	index := &LayoutIndex{SchemaVersion: 2}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "index.json")); err == nil {
+		if err := json.Unmarshal(b, index); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return index, nil
+}
+
+func writeLayoutIndex(dir string, index *LayoutIndex) error {
+	b, err := marshalDocument(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, "index.json"), append(b, '\n'), 0644)
+}
+
+// addToLayoutIndex records an untagged manifest, e.g. an artifact, unless
+// the index already lists it
+func addToLayoutIndex(dir string, desc LayoutDescriptor, artifactType string) error {
+	index, err := readLayoutIndex(dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range index.Manifests {
+		if d.Digest == desc.Digest {
+			return nil
+		}
+	}
+	desc.ArtifactType = artifactType
+	index.Manifests = append(index.Manifests, desc)
+	return writeLayoutIndex(dir, index)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLayoutIndexesSignedManifestByPayload(t *testing.T) {
+	key, err := trust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := signPayload([]byte(`{"schemaVersion": 1, "name": "library/busybox", "tag": "latest"}`), []trust.PrivateKey{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "docker-manifest-layout-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	refs := []*ImageRef{{Repo: "library/busybox", Tag: "latest"}}
+	if err := writeLayout(dir, refs, [][]byte{x}, true); err != nil {
+		t.Fatal(err)
+	}
+	index, err := readLayoutIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what --digest prints for a signed manifest with --canonical
+	printed, err := manifestDigest(x, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != printed {
+		t.Fatalf("index lists %v, --digest printed %s", index.Manifests, printed)
+	}
+
+	b, err := ioutil.ReadFile(blobPath(dir, printed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, x) || index.Manifests[0].Size != int64(len(x)) {
+		t.Fatal("blob is not the signed manifest")
+	}
+}
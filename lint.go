@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/reference"
+	flag "github.com/docker/docker/pkg/mflag"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"regexp"
+)
+
+const (
+	schema2MediaType       = "application/vnd.docker.distribution.manifest.v2+json"
+	schema2ListMediaType   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	schema2ConfigMediaType = "application/vnd.docker.container.image.v1+json"
+	ociIndexMediaType      = "application/vnd.oci.image.index.v1+json"
+	ociConfigMediaType     = "application/vnd.oci.image.config.v1+json"
+
+	// default limit for a single v1Compatibility entry when linting
+	defaultLintHistorySize = 64 << 10
+)
+
+var (
+	v1IdRegexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+	schema2LayerMediaTypes = map[string]bool{
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":         true,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": true,
+	}
+)
+
+// lintReport collects the findings for a single manifest
+type lintReport struct {
+	errors   []string
+	warnings []string
+}
+
+func (r *lintReport) errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *lintReport) warnf(format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+func lintReference(r *lintReport, name, tag string) {
+	named, err := reference.WithName(name)
+	if err != nil {
+		r.errorf("name %q: %s", name, err.Error())
+		return
+	}
+	if _, err := reference.WithTag(named, tag); err != nil {
+		r.errorf("tag %q: %s", tag, err.Error())
+	}
+}
+
+func lintDescriptor(r *lintReport, where string, d LayoutDescriptor) {
+	if d.MediaType == "" {
+		r.errorf("%s: mediaType is missing", where)
+	}
+	if d.Digest == "" {
+		r.errorf("%s: digest is missing", where)
+	} else if err := d.Digest.Validate(); err != nil {
+		r.errorf("%s: bad digest %q: %s", where, d.Digest, err.Error())
+	}
+	if d.Size < 0 {
+		r.errorf("%s: negative size %d", where, d.Size)
+	} else if d.Size == 0 {
+		r.warnf("%s: size is zero", where)
+	}
+}
+
+func lintSchema1(r *lintReport, b []byte, maxHistory int) {
+	if jsig, err := trust.ParsePrettySignature(b, "signatures"); err == nil {
+		if _, err := jsig.Verify(); err != nil {
+			r.errorf("signature verification failed: %s", err.Error())
+		}
+		if b, err = jsig.Payload(); err != nil {
+			r.errorf("error reading signed payload: %s", err.Error())
+			return
+		}
+	} else {
+		r.warnf("manifest is not signed, registries expecting schema1 reject unsigned manifests")
+	}
+
+	var m manifest.Manifest
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		r.errorf("does not match the schema1 structure: %s", err.Error())
+		return
+	}
+
+	lintReference(r, m.Name, m.Tag)
+	if m.Architecture == "" {
+		r.errorf("architecture is missing")
+	}
+	if len(m.FSLayers) == 0 {
+		r.errorf("fsLayers is empty")
+	}
+	if len(m.FSLayers) != len(m.History) {
+		r.errorf("%d fsLayers but %d history entries", len(m.FSLayers), len(m.History))
+	}
+	for i, l := range m.FSLayers {
+		if err := l.BlobSum.Validate(); err != nil {
+			r.errorf("fsLayers[%d]: bad blobSum %q: %s", i, l.BlobSum, err.Error())
+		}
+	}
+
+	seen := map[string]bool{}
+	expected := ""
+	for i, h := range m.History {
+		if maxHistory > 0 && len(h.V1Compatibility) > maxHistory {
+			r.warnf("history[%d]: v1Compatibility is %d bytes, over the %d byte limit", i, len(h.V1Compatibility), maxHistory)
+		}
+		parent, id, err := getLayerInfo([]byte(h.V1Compatibility))
+		if err != nil {
+			r.errorf("history[%d]: bad v1Compatibility: %s", i, err.Error())
+			expected = ""
+			continue
+		}
+		if !v1IdRegexp.MatchString(id) {
+			r.errorf("history[%d]: id %q is not 64 lowercase hex characters", i, id)
+		}
+		if seen[id] {
+			r.errorf("history[%d]: id %s appears more than once", i, id)
+		}
+		seen[id] = true
+		if i > 0 && expected != "" && id != expected {
+			r.errorf("history[%d]: id %s is not the parent %s of the previous entry", i, id, expected)
+		}
+		if i == len(m.History)-1 && parent != "" {
+			r.errorf("history[%d]: last entry has parent %s", i, parent)
+		}
+		expected = parent
+	}
+}
+
+func lintImageManifest(r *lintReport, b []byte, kind string) {
+	var m struct {
+		SchemaVersion int                `json:"schemaVersion"`
+		MediaType     string             `json:"mediaType"`
+		ArtifactType  string             `json:"artifactType"`
+		Config        *LayoutDescriptor  `json:"config"`
+		Layers        []LayoutDescriptor `json:"layers"`
+		Subject       *LayoutDescriptor  `json:"subject"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		r.errorf("does not match the %s structure: %s", kind, err.Error())
+		return
+	}
+
+	if m.Config == nil {
+		r.errorf("config is missing")
+	} else {
+		lintDescriptor(r, "config", *m.Config)
+		switch {
+		case kind == "schema2" && m.Config.MediaType != schema2ConfigMediaType:
+			r.errorf("config: mediaType %q, expected %s", m.Config.MediaType, schema2ConfigMediaType)
+		case kind == "oci" && m.Config.MediaType == ociEmptyMediaType && m.ArtifactType == "":
+			r.errorf("artifactType is missing, it is required when the config is empty")
+		case kind == "oci" && m.Config.MediaType != ociConfigMediaType && m.ArtifactType == "":
+			r.warnf("config: mediaType %q is not an image config, artifacts should set artifactType", m.Config.MediaType)
+		}
+	}
+
+	if len(m.Layers) == 0 && kind == "schema2" {
+		r.errorf("layers is empty")
+	}
+	for i, l := range m.Layers {
+		where := fmt.Sprintf("layers[%d]", i)
+		lintDescriptor(r, where, l)
+		if kind == "schema2" && l.MediaType != "" && !schema2LayerMediaTypes[l.MediaType] {
+			r.errorf("%s: mediaType %q is not a schema2 layer type", where, l.MediaType)
+		}
+	}
+
+	if m.Subject != nil {
+		lintDescriptor(r, "subject", *m.Subject)
+		if kind == "schema2" {
+			r.errorf("subject is only supported by OCI manifests")
+		}
+	}
+}
+
+func lintIndex(r *lintReport, b []byte, kind string) {
+	var m struct {
+		Manifests []struct {
+			LayoutDescriptor
+			Platform *struct {
+				Architecture string `json:"architecture"`
+				OS           string `json:"os"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		r.errorf("does not match the %s structure: %s", kind, err.Error())
+		return
+	}
+
+	if len(m.Manifests) == 0 {
+		r.warnf("manifests is empty")
+	}
+	for i, d := range m.Manifests {
+		where := fmt.Sprintf("manifests[%d]", i)
+		lintDescriptor(r, where, d.LayoutDescriptor)
+		if d.Platform == nil {
+			if kind == "schema2 list" {
+				r.errorf("%s: platform is missing", where)
+			}
+		} else if d.Platform.Architecture == "" || d.Platform.OS == "" {
+			r.errorf("%s: platform needs both architecture and os", where)
+		}
+	}
+}
+
+// lintManifest figures out which kind of manifest b is and checks it
+// against the rules of that kind
+func lintManifest(b []byte, maxHistory int) *lintReport {
+	r := &lintReport{}
+	if len(b) > maxManifestSize {
+		r.errorf("manifest is %d bytes, registries accept at most %d", len(b), maxManifestSize)
+	}
+
+	var head struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Config        json.RawMessage `json:"config"`
+		Manifests     json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(b, &head); err != nil {
+		r.errorf("not a JSON object: %s", err.Error())
+		return r
+	}
+
+	switch head.SchemaVersion {
+	case 1:
+		lintSchema1(r, b, maxHistory)
+	case 2:
+		switch head.MediaType {
+		case schema2MediaType:
+			lintImageManifest(r, b, "schema2")
+		case ociManifestMediaType:
+			lintImageManifest(r, b, "oci")
+		case schema2ListMediaType:
+			lintIndex(r, b, "schema2 list")
+		case ociIndexMediaType:
+			lintIndex(r, b, "oci index")
+		case "":
+			// mediaType is optional in OCI documents but required by
+			// registries to tell them apart from docker ones
+			r.errorf("mediaType is missing")
+			if head.Manifests != nil {
+				lintIndex(r, b, "oci index")
+			} else if bytes.Contains(head.Config, []byte(schema2ConfigMediaType)) {
+				lintImageManifest(r, b, "schema2")
+			} else {
+				lintImageManifest(r, b, "oci")
+			}
+		default:
+			r.errorf("unknown mediaType %q", head.MediaType)
+		}
+	case 0:
+		r.errorf("schemaVersion is missing")
+	default:
+		r.errorf("unknown schemaVersion %d", head.SchemaVersion)
+	}
+	return r
+}
+
+func cmdLint(args []string) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	ref := fs.String([]string{"-reference"}, "", "Also check NAME:TAG, the reference the manifests will be pushed as")
+	maxHistory := fs.Int([]string{"-max-history-size"}, defaultLintHistorySize, "Warn when a v1Compatibility entry exceeds this many bytes")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: lint [--reference NAME:TAG] MANIFEST...")
+	}
+
+	failed := 0
+	for _, fn := range fs.Args() {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+
+		r := lintManifest(b, *maxHistory)
+		if *ref != "" {
+			name, tag := splitReference(*ref)
+			if tag == "" {
+				tag = "latest"
+			}
+			lintReference(r, name, tag)
+		}
+
+		for _, w := range r.warnings {
+			fmt.Printf("%s: WARNING %s\n", fn, w)
+		}
+		for _, e := range r.errors {
+			fmt.Printf("%s: ERROR   %s\n", fn, e)
+		}
+		if len(r.errors) > 0 {
+			failed++
+		} else {
+			fmt.Printf("%s: OK\n", fn)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d manifests have problems", failed, fs.NArg())
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"compress/gzip"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,38 +19,202 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"text/template"
+	"time"
 )
 
 var (
-	verbose, help, print_digest bool
-	target, key                 string
+	verbose, help, print_digest, keep_going bool
+	all_tags, trim_history, quiet           bool
+	canonical, compact, strict, throwaway   bool
+	flatten, diff_ids                       bool
+	max_history, truncate_cmd, jobs         int
+	compress_threads                        int
+	strip_container_config                  bool
+	target, selected, name, tag             string
+	key_files                               stringList
+	archive_out, architecture, os_name      string
+	refs_file, output, output_dir           string
+	layout_out, digest_file, format         string
+	output_format, tag_from, sign_log       string
+	redact_file, vault_addr, vault_key      string
+	cert_chain_file, simple_sign_dir        string
+	gpg_key, sign_registry                  string
+	provenance_out, builder_id              string
+	max_memory, blob_cache, previous_file   string
+	digest_report                           string
+	cert_chain                              []*x509.Certificate
+	format_tmpl                             *template.Template
+	redaction                               *RedactionConfig
+	previous                                map[string]*previousLayer
+	digests                                 []digest.Digest
+	digest_algorithm                        digest.Algorithm
+	pre_hooks, post_hooks, skip_base        stringList
+	report_algorithms                       stringList
+	failures                                []error
+	broken_chains                           int
+	http_timeout                            time.Duration
 )
 
 type Layer struct {
-	Id, Parent string
-	BlobSum    digest.Digest
-	Data       string
+	Id, Parent       string
+	Architecture, OS string
+	BlobSum          digest.Digest
+	Data             string
+	Empty            bool
 }
 
 type LayerMap map[string]*Layer
 
+func (lm LayerMap) setBlobSum(id string, sum digest.Digest, empty bool) {
+	if _, ok := lm[id]; !ok {
+		lm[id] = &Layer{Id: id}
+	}
+	lm[id].BlobSum, lm[id].Empty = sum, empty
+}
+
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+type ImageRef struct {
+	Repo, Tag, TopId string
+}
+
 func init() {
-	flag.Bool([]string{"h", "-help"}, false, "Display help")
+	flag.BoolVar(&help, []string{"h", "-help"}, false, "Display help")
 	flag.BoolVar(&verbose, []string{"v", "-verbose"}, false, "Switch to verbose output")
 	flag.BoolVar(&print_digest, []string{"d", "-digest"}, false, "Print also digest of manifest")
-	flag.StringVar(&key, []string{"k", "-key-file"}, "", "Private key with which to sign")
-	flag.Parse()
+	flag.BoolVar(&quiet, []string{"q", "-quiet"}, false, "Print only the digest of the manifest")
+	flag.BoolVar(&canonical, []string{"-canonical"}, false, "Compute digests over the canonical payload, stable between signed and unsigned output")
+	flag.BoolVar(&compact, []string{"-compact"}, false, "Emit single-line JSON documents")
+	flag.StringVar(&format, []string{"f", "-format"}, "", "Format the output using the given Go template")
+	flag.StringVar(&output_format, []string{"-output-format"}, "json", "Serialization of emitted manifests, json or yaml (unsigned only)")
+	flag.StringVar(&digest_file, []string{"-digest-file"}, "", "Write digest of every emitted manifest to a file")
+	flag.Var(&key_files, []string{"k", "-key-file"}, "Private key or directory of keys with which to sign, may be repeated")
+	flag.StringVar(&vault_addr, []string{"-vault-addr"}, os.Getenv("VAULT_ADDR"), "Address of the Vault server used with --vault-key")
+	flag.StringVar(&vault_key, []string{"-vault-key"}, "", "Sign with a Vault transit key, given as NAME or MOUNT/NAME")
+	flag.StringVar(&cert_chain_file, []string{"-cert-chain"}, "", "PEM certificate chain of the signing key, embedded as x5c in the signature")
+	flag.StringVar(&simple_sign_dir, []string{"-simple-signing-dir"}, "", "Write GPG-signed simple signing claims into a lookaside directory")
+	flag.StringVar(&gpg_key, []string{"-gpg-key"}, "", "GPG key used with --simple-signing-dir (default key otherwise)")
+	flag.StringVar(&sign_registry, []string{"-signature-registry"}, "docker.io", "Registry of the docker-reference in simple signing claims")
+	flag.StringVar(&provenance_out, []string{"-provenance"}, "", "Write an in-toto SLSA provenance statement, DSSE-signed when signing")
+	flag.StringVar(&builder_id, []string{"-builder-id"}, "docker-manifest", "Builder identity recorded in the provenance statement")
+	flag.StringVar(&selected, []string{"s", "-select"}, "", "Only output manifests for given repository or repository:tag")
+	flag.StringVar(&name, []string{"n", "-name"}, "", "Override repository name of the manifest")
+	flag.StringVar(&tag, []string{"t", "-tag"}, "", "Override tag of the manifest")
+	flag.StringVar(&tag_from, []string{"-tag-from"}, "", "Resolve the tag override from git, env:VAR, file:PATH or exec:COMMAND")
+	flag.StringVar(&architecture, []string{"-architecture"}, "", "Architecture used when the image JSON does not record one (default amd64)")
+	flag.StringVar(&os_name, []string{"-os"}, "", "Operating system used when the image JSON does not record one")
+	flag.StringVar(&output, []string{"o", "-output"}, "", "Write the manifest to a file instead of stdout")
+	flag.StringVar(&output_dir, []string{"-output-dir"}, "", "Write every manifest to <repo>_<tag>.json in given directory")
+	flag.StringVar(&layout_out, []string{"-layout-out"}, "", "Write manifests and gzipped layer blobs into a content-addressed blobs/ tree")
+	flag.StringVar(&archive_out, []string{"-archive-out"}, "", "Write a copy of the tarball with the manifests embedded")
+	flag.BoolVar(&all_tags, []string{"-all-tags"}, false, "Write manifest of every repository:tag to <repo>_<tag>.json")
+	flag.StringVar(&sign_log, []string{"-log"}, "", "Append digests of signed manifests to a hash-chained log file")
+	flag.Var(&pre_hooks, []string{"-pre-hook"}, "Command or URL notified before each generate/sign stage")
+	flag.Var(&post_hooks, []string{"-post-hook"}, "Command or URL notified after each generate/sign stage")
+	flag.DurationVar(&http_timeout, []string{"-http-timeout"}, 30*time.Second, "Give up on webhooks and other HTTP requests after this long")
+	flag.StringVar(&refs_file, []string{"-refs-file"}, os.Getenv("DOCKER_MANIFEST_REFS"), "JSON file mapping aliases to references usable with --select and --name")
+	flag.StringVar(&blob_cache, []string{"-blob-cache"}, os.Getenv("DOCKER_MANIFEST_CACHE"), "Directory caching blob sums of layers between runs")
+	flag.StringVar(&previous_file, []string{"-previous"}, "", "Reuse blob sums and history of layers found in an earlier manifest of the image")
+	flag.StringVar(&redact_file, []string{"-redact"}, "", "JSON file listing labels and env vars to drop or rewrite in the history")
+	flag.BoolVar(&trim_history, []string{"-trim-history-fields"}, false, "Drop non-essential fields (container_config, ...) from v1Compatibility")
+	flag.BoolVar(&strip_container_config, []string{"-strip-container-config"}, false, "Drop container_config from v1Compatibility")
+	flag.IntVar(&truncate_cmd, []string{"-truncate-cmd"}, 0, "Truncate the arguments of container_config.Cmd in v1Compatibility to this many bytes")
+	flag.IntVar(&max_history, []string{"-max-history-size"}, 0, "Fail when a v1Compatibility entry exceeds this many bytes")
+	flag.Var(&skip_base, []string{"-skip-base-layers"}, "Leave out the bottom N layers, or base layers with given id or blob sum, may be repeated")
+	digest_algorithm = digest.Canonical
+	flag.Var(&digest_algorithm, []string{"-digest-algorithm"}, "Algorithm of layer digests in manifests and layouts, sha256, sha384 or sha512")
+	flag.StringVar(&digest_report, []string{"-digest-report"}, "", "Write the sha256 and sha512 digests of every layer to a file")
+	flag.Var(&report_algorithms, []string{"-report-algorithm"}, "Also digest layers with this algorithm for --digest-report, may be repeated")
+	flag.BoolVar(&diff_ids, []string{"-diff-ids"}, false, "Output the digests of the uncompressed layers instead of manifests, skipping compression")
+	flag.BoolVar(&flatten, []string{"-flatten"}, false, "Merge all layers into one, use with --layout-out to keep the new blob")
+	flag.BoolVar(&throwaway, []string{"-throwaway"}, true, "Mark history entries of empty layers as throwaway")
+	flag.BoolVar(&strict, []string{"-strict"}, true, "Abort on unreadable tar entries instead of producing a manifest without them")
+	flag.IntVar(&jobs, []string{"j", "-jobs"}, 1, "Number of layers compressed and hashed in parallel, spooling them to temporary files")
+	flag.IntVar(&compress_threads, []string{"-compress-threads"}, 1, "Gzip each layer on this many threads, changes the blob sums from those of single-threaded gzip")
+	flag.StringVar(&max_memory, []string{"-max-memory"}, "", "Soft memory limit, e.g. 512MB, lowering --jobs and --compress-threads to fit")
+	flag.BoolVar(&keep_going, []string{"-keep-going"}, false, "Continue with remaining images and tarballs after an error")
 }
 
-func blobSumLayer(r *tar.Reader) (digest.Digest, error) {
-	sha := digest.Canonical.New()
-	gw := gzip.NewWriter(sha.Hash())
-	if _, err := io.Copy(gw, r); err != nil {
+// isGzip peeks for the gzip magic, some save formats store layers
+// compressed already
+func isGzip(br *bufio.Reader) bool {
+	b, err := br.Peek(2)
+	return err == nil && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// layers are always compressed at the same level and with a gzip header
+// carrying no name or mtime, so blobs and their sums are reproducible
+const layerCompressionLevel = gzip.DefaultCompression
+
+func blobSumLayer(r io.Reader, blob io.Writer) (digest.Digest, error) {
+	md := newLayerDigester()
+	var w io.Writer = md
+	if blob != nil {
+		w = io.MultiWriter(w, blob)
+	}
+
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	// compressing again would change what the blob sum refers to
+	br := bufio.NewReader(r)
+	if isGzip(br) {
+		if _, err := io.CopyBuffer(w, br, *buf); err != nil {
+			return "", err
+		}
+		return recordDigests(md), nil
+	}
+
+	var gw io.WriteCloser
+	if compress_threads > 1 {
+		gw = newParallelGzipWriter(w, compress_threads)
+	} else {
+		z := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(z)
+		z.Reset(w)
+		gw = z
+	}
+	if _, err := io.CopyBuffer(gw, br, *buf); err != nil {
+		return "", err
+	}
+	if err := gw.Close(); err != nil {
 		return "", err
 	}
-	gw.Close()
-	return sha.Digest(), nil
+	return recordDigests(md), nil
+}
+
+// sumLayer computes the digest a layer is referred to by, with --diff-ids
+// that of the uncompressed tar, storing the blob with --layout-out
+func sumLayer(r io.Reader) (digest.Digest, error) {
+	switch {
+	case diff_ids:
+		br := bufio.NewReader(r)
+		if !isGzip(br) {
+			return digestLayer(br)
+		}
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer gr.Close()
+		return digestLayer(gr)
+	case layout_out != "":
+		return writeLayerBlob(layout_out, r)
+	}
+	return blobSumLayer(r, nil)
 }
 
 func getLayerPrefix(s string) string {
@@ -57,93 +223,156 @@ func getLayerPrefix(s string) string {
 }
 
 func getLayerInfo(b []byte) (string, string, error) {
-	var raw map[string]interface{}
+	var raw struct {
+		Id, Parent string
+	}
 	if err := json.Unmarshal(b, &raw); err != nil {
 		return "", "", err
 	}
-	if raw["parent"] == nil {
-		return "", raw["id"].(string), nil
+	if raw.Id == "" {
+		return "", "", errors.New("missing layer id")
 	}
-	return raw["parent"].(string), raw["id"].(string), nil
+	return raw.Parent, raw.Id, nil
 }
 
-func getLayersFromMap(lm LayerMap) []*Layer {
-	out := make([]*Layer, 0, len(lm))
-	for _, v := range lm {
-		out = append(out, v)
+// preserveFields copies the given keys of the original image JSON that
+// image.Image does not know about (e.g. windows os.version) into b
+func preserveFields(b, orig []byte, keys ...string) []byte {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(orig, &raw); err != nil {
+		return b
 	}
-	return out
-}
 
-func findChild(id string, layers []*Layer) *Layer {
-	for _, l := range layers {
-		if l.Parent == id {
-			return l
+	var extra bytes.Buffer
+	for _, k := range keys {
+		if v, ok := raw[k]; ok {
+			kb, _ := json.Marshal(k)
+			extra.WriteByte(',')
+			extra.Write(kb)
+			extra.WriteByte(':')
+			json.Compact(&extra, v)
 		}
 	}
-	return nil
-}
-
-func getLayersInOrder(layers []*Layer) []*Layer {
-	root := findChild("", layers)
-
-	if root == nil {
-		panic(errors.New("Unable to find root layer"))
+	if extra.Len() == 0 {
+		return b
 	}
 
-	out := make([]*Layer, 0, len(layers))
-	out = append(out, root)
-	for {
-		root = findChild(root.Id, layers)
-		if root == nil {
-			break
+	out := append([]byte{}, b[:len(b)-1]...)
+	out = append(out, extra.Bytes()...)
+	return append(out, '}')
+}
+
+func getLayerChain(top string, layers LayerMap) ([]*Layer, error) {
+	out := []*Layer{}
+	walked := []string{}
+	seen := map[string]bool{}
+	for id := top; id != ""; {
+		walked = append(walked, id)
+		l, ok := layers[id]
+		switch {
+		case !ok && len(out) == 0:
+			return nil, newChainError(fmt.Sprintf("top layer %s is missing from the archive", id), walked, layers)
+		case !ok:
+			return nil, newChainError(fmt.Sprintf("layer %s, parent of %s, is missing from the archive", id, out[len(out)-1].Id), walked, layers)
+		case seen[id]:
+			return nil, newChainError(fmt.Sprintf("layer %s is its own ancestor", id), walked, layers)
+		case l.Data == "":
+			return nil, newChainError(fmt.Sprintf("json of layer %s is missing, its parent is unknown", id), walked, layers)
+		case l.BlobSum == "":
+			return nil, newChainError(fmt.Sprintf("layer.tar of layer %s is missing", id), walked, layers)
 		}
-		out = append(out, root)
+		seen[id] = true
+		out = append(out, l)
+		id = l.Parent
 	}
+	return out, nil
+}
 
-	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
-		out[i], out[j] = out[j], out[i]
+func overrideReferences(refs []*ImageRef, name, tag string) error {
+	if name != "" && !strings.Contains(name, "/") {
+		name = "library/" + name
 	}
 
-	return out
+	seen := map[string]bool{}
+	for _, r := range refs {
+		if name != "" {
+			r.Repo = name
+		}
+		if tag != "" {
+			r.Tag = tag
+		}
+		if seen[r.Repo+":"+r.Tag] {
+			return fmt.Errorf("overriding yields duplicate reference %s:%s, use --select to pick one image", r.Repo, r.Tag)
+		}
+		seen[r.Repo+":"+r.Tag] = true
+	}
+	return nil
 }
 
-func getRepoInfo(ri map[string]interface{}) (string, string) {
-	var (
-		repo string
-		tag  string
-	)
-
+// getRepoInfo lists the images of a parsed repositories file, which maps
+// repositories to tags to top layer ids
+func getRepoInfo(ri map[string]interface{}) ([]*ImageRef, error) {
+	out := []*ImageRef{}
 	for k, v := range ri {
-		repo = k
-		for vv, _ := range v.(map[string]interface{}) {
-			tag = vv
+		repo := k
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+		tags, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("repository %s is not an object of tags", k)
+		}
+		for tag, id := range tags {
+			s, ok := id.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s:%s is not a layer id", k, tag)
+			}
+			out = append(out, &ImageRef{Repo: repo, Tag: tag, TopId: s})
 		}
 	}
-
-	return repo, tag
+	sort.Sort(byRepo(out))
+	return out, nil
 }
 
-func outputManifestFor(target string) {
-	var pkey trust.PrivateKey
+type byRepo []*ImageRef
 
-	if key != "" {
-		var err error
-		pkey, err = trust.LoadKeyFile(key)
-		if err != nil {
-			fmt.Printf("error loading key: %s\n", err.Error())
-			return
-		}
+func (r byRepo) Len() int      { return len(r) }
+func (r byRepo) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byRepo) Less(i, j int) bool {
+	if r[i].Repo == r[j].Repo {
+		return r[i].Tag < r[j].Tag
 	}
+	return r[i].Repo < r[j].Repo
+}
 
-	if verbose {
-		fmt.Errorf("signing with: %s\n", pkey.KeyID())
+func splitReference(s string) (string, string) {
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		return s[:i], s[i+1:]
 	}
+	return s, ""
+}
+
+func selectImages(refs []*ImageRef, sel string) []*ImageRef {
+	if sel == "" {
+		return refs
+	}
+	repo, tag := splitReference(sel)
+	if !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	out := []*ImageRef{}
+	for _, r := range refs {
+		if r.Repo == repo && (tag == "" || r.Tag == tag) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
 
+func readArchive(target string) (LayerMap, []*ImageRef, error) {
 	f, err := os.Open(target)
 	if err != nil {
-		fmt.Printf("error opening file: %s\n", err.Error())
-		return
+		return nil, nil, fmt.Errorf("error opening file: %s", err.Error())
 	}
 
 	defer func() {
@@ -152,30 +381,109 @@ func outputManifestFor(target string) {
 		}
 	}()
 
-	var (
-		repo, tag string
-	)
+	var refs []*ImageRef
 	layers := LayerMap{}
+
+	var pool *hashPool
+	spooled := map[string]bool{}
+	cacheKeys := map[string]string{}
+	if jobs > 1 {
+		pool = newHashPool(jobs)
+		defer pool.wait()
+	}
+
 	t := tar.NewReader(bufio.NewReader(f))
 	for {
 		hdr, err := t.Next()
 		if err == io.EOF {
 			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("error reading archive: %s", err.Error())
 		}
 
-		if strings.HasSuffix(hdr.Name, "layer.tar") {
+		// without --strict broken entries are skipped, which yields a
+		// manifest that is missing layers or history
+		check := func(what string, err error) error {
+			if err == nil {
+				return nil
+			}
+			if strict {
+				return fmt.Errorf("%s: error %s: %s", hdr.Name, what, err.Error())
+			}
+			fmt.Fprintf(os.Stderr, "warning: %s: error %s: %s\n", hdr.Name, what, err.Error())
+			return nil
+		}
+
+		if path.Base(hdr.Name) == "layer.tar" {
 			id := getLayerPrefix(hdr.Name)
-			sum, _ := blobSumLayer(t)
-			if _, ok := layers[id]; !ok {
-				layers[id] = &Layer{Id: id}
-			} else {
-				layers[id].BlobSum = sum
+			// a layer shared by several images may be stored more than once,
+			// the first copy is authoritative and only digested once
+			if l, ok := layers[id]; ok && l.BlobSum != "" || spooled[id] {
+				if verbose {
+					fmt.Fprintf(os.Stderr, "skipping duplicate layer.tar of %s\n", id)
+				}
+				continue
+			}
+
+			if p, ok := previous[id]; ok && p.reusable() {
+				if verbose {
+					fmt.Fprintf(os.Stderr, "reusing %s from the previous manifest\n", id)
+				}
+				layers.setBlobSum(id, p.BlobSum, p.throwaway())
+				continue
+			}
+
+			if blob_cache != "" {
+				key := blobCacheKey(id, hdr)
+				if c, ok := lookupBlobSum(key); ok {
+					if verbose {
+						fmt.Fprintf(os.Stderr, "using cached blob sum of %s\n", id)
+					}
+					layers.setBlobSum(id, c.BlobSum, c.Empty)
+					continue
+				}
+				cacheKeys[id] = key
+			}
+
+			if pool != nil {
+				if err := check("spooling layer", pool.spool(id, t)); err != nil {
+					return nil, nil, err
+				}
+				spooled[id] = true
+				continue
 			}
+
+			z := &zeroWriter{}
+			r := io.TeeReader(t, z)
+			sum, err := sumLayer(r)
+			if err := check("computing blob sum", err); err != nil {
+				return nil, nil, err
+			} else if sum == "" {
+				continue
+			}
+			layers.setBlobSum(id, sum, !z.nonzero)
 		}
 
-		if strings.HasSuffix(hdr.Name, "json") {
-			data, _ := ioutil.ReadAll(t)
-			parent, id, _ := getLayerInfo(data)
+		if path.Base(hdr.Name) == "json" {
+			data, err := ioutil.ReadAll(t)
+			if err != nil {
+				if err := check("reading layer json", err); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			parent, id, err := getLayerInfo(data)
+			if err := check("parsing layer json", err); err != nil {
+				return nil, nil, err
+			} else if id == "" {
+				continue
+			}
+			if l, ok := layers[id]; ok && l.Data != "" {
+				if verbose {
+					fmt.Fprintf(os.Stderr, "skipping duplicate json of %s\n", id)
+				}
+				continue
+			}
 			if _, ok := layers[id]; !ok {
 				layers[id] = &Layer{Id: id, Parent: parent}
 			} else {
@@ -183,62 +491,598 @@ func outputManifestFor(target string) {
 			}
 
 			var img image.Image
-			json.Unmarshal(data, &img)
+			if err := check("parsing layer json", json.Unmarshal(data, &img)); err != nil {
+				return nil, nil, err
+			}
+			if img.Architecture == "" {
+				img.Architecture = architecture
+			}
+			if img.OS == "" {
+				img.OS = os_name
+			}
+			layers[id].Architecture, layers[id].OS = img.Architecture, img.OS
 			b, _ := json.Marshal(img)
+			b = preserveFields(b, data, "os.version", "os.features", "throwaway")
 			layers[id].Data = string(b) + "\n"
 		}
 
 		if hdr.Name == "repositories" {
-			r, _ := ioutil.ReadAll(t)
+			r, err := ioutil.ReadAll(t)
+			if err != nil {
+				if err := check("reading repositories", err); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
 			var raw map[string]interface{}
 			if err := json.Unmarshal(r, &raw); err != nil {
-				return
+				return nil, nil, fmt.Errorf("error parsing repositories: %s", err.Error())
+			}
+
+			if refs, err = getRepoInfo(raw); err != nil {
+				if err := check("parsing repositories", err); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	if pool != nil {
+		for _, r := range pool.wait() {
+			if r.err != nil {
+				if strict {
+					return nil, nil, fmt.Errorf("%s/layer.tar: error computing blob sum: %s", r.id, r.err.Error())
+				}
+				fmt.Fprintf(os.Stderr, "warning: %s/layer.tar: error computing blob sum: %s\n", r.id, r.err.Error())
+				continue
+			}
+			layers.setBlobSum(r.id, r.sum, r.empty)
+		}
+	}
+
+	for id, key := range cacheKeys {
+		if l, ok := layers[id]; ok && l.BlobSum != "" {
+			if err := storeBlobSum(key, l.BlobSum, l.Empty, blobDigests[l.BlobSum]); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: error caching blob sum of %s: %s\n", id, err.Error())
+			}
+		}
+	}
+
+	return layers, refs, nil
+}
+
+func outputManifestFor(target string, pkeys []trust.PrivateKey) error {
+	started := time.Now()
+	layers, refs, err := readArchive(target)
+	if err != nil {
+		return err
+	}
+
+	refs = selectImages(refs, selected)
+	if len(refs) == 0 {
+		return errors.New("no matching images found")
+	}
+
+	if err := overrideReferences(refs, name, tag); err != nil {
+		return err
+	}
+
+	out := make([][]byte, 0, len(refs))
+	done := make([]*ImageRef, 0, len(refs))
+	for _, ref := range refs {
+		var x []byte
+		var err error
+		if flatten {
+			err = flattenImage(target, ref, layers)
+		}
+		if err == nil && diff_ids {
+			x, err = generateDiffIDs(ref, layers)
+		} else if err == nil {
+			x, err = generateManifest(ref, layers, pkeys)
+		}
+		if _, ok := err.(*chainError); ok {
+			broken_chains++
+		}
+		if err != nil {
+			err = fmt.Errorf("%s:%s: %s", ref.Repo, ref.Tag, err.Error())
+			if !keep_going {
+				return err
+			}
+			failures = append(failures, fmt.Errorf("%s: %s", target, err.Error()))
+			continue
+		}
+
+		dgstr, err := manifestDigest(x, len(pkeys) > 0 && canonical)
+		if err != nil {
+			return err
+		}
+		if format_tmpl != nil {
+			if err := formatManifest(os.Stdout, format_tmpl, x, dgstr); err != nil {
+				return fmt.Errorf("error formatting manifest: %s", err.Error())
+			}
+		} else if print_digest || quiet {
+			fmt.Println(string(dgstr))
+		}
+		digests = append(digests, dgstr)
+
+		if simple_sign_dir != "" {
+			// containers/image identifies schema1 manifests by their payload
+			d, err := manifestDigest(x, len(pkeys) > 0)
+			if err != nil {
+				return err
+			}
+			fn, err := writeSimpleSignature(simple_sign_dir, sign_registry, ref, d)
+			if err != nil {
+				return fmt.Errorf("error writing simple signature: %s", err.Error())
+			}
+			if verbose {
+				fmt.Fprintf(os.Stderr, "wrote simple signature of %s:%s to %s\n", ref.Repo, ref.Tag, fn)
+			}
+		}
+
+		if sign_log != "" && len(pkeys) > 0 {
+			if err := appendLog(sign_log, ref, dgstr, keyIds(pkeys)); err != nil {
+				return fmt.Errorf("error writing log: %s", err.Error())
 			}
+		}
 
-			repo, tag = getRepoInfo(raw)
-			if !strings.Contains(repo, "/") {
-				repo = "library/" + repo
+		if digest_report != "" {
+			if err := addToReport(ref, layers); err != nil {
+				return fmt.Errorf("error reporting digests of %s:%s: %s", ref.Repo, ref.Tag, err.Error())
 			}
 		}
+
+		out = append(out, x)
+		done = append(done, ref)
+	}
+
+	if archive_out != "" {
+		if err := writeArchive(target, archive_out, done, out); err != nil {
+			return fmt.Errorf("error writing archive: %s", err.Error())
+		}
+	}
+
+	if provenance_out != "" && len(done) > 0 {
+		if err := writeProvenance(provenance_out, target, started, done, out, pkeys); err != nil {
+			return fmt.Errorf("error writing provenance: %s", err.Error())
+		}
+	}
+
+	if layout_out != "" {
+		if err := writeLayout(layout_out, done, out, len(pkeys) > 0); err != nil {
+			return fmt.Errorf("error writing layout: %s", err.Error())
+		}
+	}
+
+	if output_format == "yaml" {
+		for i := range out {
+			if out[i], err = toYAML(out[i]); err != nil {
+				return fmt.Errorf("error converting manifest to yaml: %s", err.Error())
+			}
+		}
+	}
+
+	if all_tags || output_dir != "" {
+		for i, ref := range done {
+			fn := filepath.Join(output_dir, manifestFileName(ref))
+			if output_format == "yaml" {
+				fn = strings.TrimSuffix(fn, ".json") + ".yaml"
+			}
+			if err := writeFileAtomic(fn, append(out[i], '\n'), 0644); err != nil {
+				return fmt.Errorf("error writing manifest: %s", err.Error())
+			}
+			if verbose {
+				fmt.Fprintf(os.Stderr, "wrote %s:%s to %s\n", ref.Repo, ref.Tag, fn)
+			}
+		}
+		return nil
+	}
+
+	// signed manifests must be emitted byte for byte, so the array is
+	// assembled by hand rather than re-marshalled
+	var b []byte
+	if output_format == "yaml" {
+		b = bytes.Join(out, []byte("---\n"))
+	} else if len(out) == 1 {
+		b = append(out[0], '\n')
+	} else if len(out) > 1 {
+		b = []byte(fmt.Sprintf("[\n%s\n]\n", bytes.Join(out, []byte(",\n"))))
+	}
+
+	if output != "" {
+		if err := writeFileAtomic(output, b, 0644); err != nil {
+			return fmt.Errorf("error writing manifest: %s", err.Error())
+		}
+		return nil
+	}
+
+	if !quiet && format_tmpl == nil {
+		os.Stdout.Write(b)
+	}
+	return nil
+}
+
+func marshalDocument(v interface{}) ([]byte, error) {
+	if compact {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "   ")
+}
+
+func signPayload(p []byte, pkeys []trust.PrivateKey) ([]byte, error) {
+	js, err := trust.NewJSONSignature(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, pkey := range pkeys {
+		if chainMatches(cert_chain, pkey) {
+			err = js.SignWithChain(pkey, cert_chain)
+		} else {
+			err = js.Sign(pkey)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	x, err := js.PrettySignature("signatures")
+	if err != nil || !compact {
+		return x, err
+	}
+
+	// the payload is recovered from a prefix of the document, which is
+	// already compact and therefore left intact by compacting the rest
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, x); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// manifestDigest hashes the manifest bytes, with canonical set the digest of
+// a signed manifest is taken over its JWS payload instead, which equals the
+// unsigned output and is what a registry addresses the manifest by
+func manifestDigest(x []byte, canonical bool) (digest.Digest, error) {
+	if canonical {
+		jsig, err := trust.ParsePrettySignature(x, "signatures")
+		if err != nil {
+			return "", err
+		}
+		if x, err = jsig.Payload(); err != nil {
+			return "", err
+		}
+	}
+	return digest.FromBytes(x)
+}
+
+// imageLayers returns the layer chain of ref, top first, and how many
+// base layers of it --skip-base-layers leaves out
+func imageLayers(ref *ImageRef, layers LayerMap) ([]*Layer, int, error) {
+	chain, err := getLayerChain(ref.TopId, layers)
+	if err != nil || len(skip_base) == 0 {
+		return chain, 0, err
+	}
+	skip, err := skippedBaseLayers(chain, skip_base)
+	if err != nil {
+		return nil, 0, err
+	}
+	return chain, skip, nil
+}
+
+func generateManifest(ref *ImageRef, layers LayerMap, pkeys []trust.PrivateKey) ([]byte, error) {
+	ev := &HookEvent{Name: ref.Repo, Tag: ref.Tag}
+	if err := runHooks(pre_hooks, "generate", "pre", ev); err != nil {
+		return nil, err
 	}
 
 	m := manifest.Manifest{
 		Versioned: versioned.Versioned{
 			SchemaVersion: 1,
 		},
-		Name: repo, Tag: tag, Architecture: "amd64"}
+		Name: ref.Repo, Tag: ref.Tag, Architecture: "amd64"}
+
+	chain, skip, err := imageLayers(ref, layers)
+	if err != nil {
+		return nil, err
+	}
+	if verbose && skip > 0 {
+		fmt.Fprintf(os.Stderr, "skipping %d base layers of %s:%s\n", skip, ref.Repo, ref.Tag)
+	}
+	chain = chain[:len(chain)-skip]
 
-	ll := getLayersFromMap(layers)
-	for _, l := range getLayersInOrder(ll) {
+	if len(chain) > 0 && chain[0].Architecture != "" {
+		m.Architecture = chain[0].Architecture
+	}
+
+	history := make([]string, 0, len(chain))
+	for _, l := range chain {
+		data := l.Data
+		if l.Empty && throwaway {
+			if verbose {
+				fmt.Fprintf(os.Stderr, "layer %s of %s:%s is empty, marking it throwaway\n", l.Id, ref.Repo, ref.Tag)
+			}
+			if data, err = markThrowaway(data); err != nil {
+				return nil, fmt.Errorf("error marking %s throwaway: %s", l.Id, err.Error())
+			}
+		}
+		if redaction != nil {
+			if data, err = redactHistory(data, redaction); err != nil {
+				return nil, fmt.Errorf("error redacting history of %s: %s", l.Id, err.Error())
+			}
+		}
+		if truncate_cmd > 0 {
+			if data, err = truncateCmd(data, truncate_cmd); err != nil {
+				return nil, fmt.Errorf("error truncating history of %s: %s", l.Id, err.Error())
+			}
+		}
+		if strip_container_config {
+			if data, err = stripFields(data, "container_config"); err != nil {
+				return nil, fmt.Errorf("error trimming history of %s: %s", l.Id, err.Error())
+			}
+		}
+		if trim_history {
+			if data, err = trimHistory(data); err != nil {
+				return nil, fmt.Errorf("error trimming history of %s: %s", l.Id, err.Error())
+			}
+		}
+		history = append(history, data)
 		m.FSLayers = append(m.FSLayers, manifest.FSLayer{BlobSum: l.BlobSum})
-		m.History = append(m.History, manifest.History{V1Compatibility: l.Data})
+		m.History = append(m.History, manifest.History{V1Compatibility: data})
 	}
 
-	var x []byte
-	if pkey != nil {
-		var sm *manifest.SignedManifest
-		sm, err = manifest.Sign(&m, pkey)
-		x, err = sm.MarshalJSON()
-	} else {
-		x, err = json.MarshalIndent(m, "", "   ")
+	if err := checkHistorySize(chain, history, max_history); err != nil {
+		return nil, err
+	}
+
+	// the unsigned manifest doubles as the JWS payload when signing
+	x, err := marshalDocument(m)
+	if err != nil {
+		return nil, err
 	}
 
-	if print_digest {
-		dgstr, _ := digest.FromBytes(x)
-		fmt.Println(string(dgstr))
+	ev.Digest, _ = digest.FromBytes(x)
+	if err := runHooks(post_hooks, "generate", "post", ev); err != nil {
+		return nil, err
+	}
+
+	if len(pkeys) == 0 {
+		if verbose {
+			fmt.Fprintf(os.Stderr, "manifest size of %s:%s: %d bytes\n", ref.Repo, ref.Tag, len(x))
+		}
+		return x, nil
 	}
 
-	fmt.Println(string(x))
+	ev.KeyIds = keyIds(pkeys)
+	if err := runHooks(pre_hooks, "sign", "pre", ev); err != nil {
+		return nil, err
+	}
+
+	if x, err = signPayload(x, pkeys); err != nil {
+		return nil, err
+	}
+
+	ev.Digest, _ = digest.FromBytes(x)
+	if err := runHooks(post_hooks, "sign", "post", ev); err != nil {
+		return nil, err
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "manifest size of %s:%s: %d bytes\n", ref.Repo, ref.Tag, len(x))
+	}
+	return x, nil
 }
 
 func main() {
-	if help {
+	flag.Parse()
+	if help || flag.NArg() == 0 {
 		flag.PrintDefaults()
-	} else {
-		target := flag.Arg(0)
-		if target != "" {
-			//fmt.Printf("outputting manifest for: %q with key: %q\n", target, key)
-			outputManifestFor(target)
+		printCommands()
+		return
+	}
+
+	if cmd := findCommand(flag.Arg(0)); cmd != nil {
+		if err := cmd.Run(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	pkeys, err := loadKeys(key_files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading key: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if vault_key != "" {
+		k, err := loadVaultKey(vault_addr, vault_key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading vault key: %s\n", err.Error())
+			os.Exit(1)
+		}
+		pkeys = append(pkeys, k)
+	}
+
+	if cert_chain_file != "" {
+		var err error
+		if cert_chain, err = loadCertChain(cert_chain_file, pkeys); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading certificate chain: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if verbose {
+		for _, pkey := range pkeys {
+			fmt.Fprintf(os.Stderr, "signing with: %s\n", pkey.KeyID())
+		}
+	}
+
+	if tag_from != "" {
+		if tag != "" {
+			fmt.Fprintln(os.Stderr, "error: --tag and --tag-from are mutually exclusive")
+			os.Exit(1)
+		}
+
+		var err error
+		if tag, err = resolveTag(tag_from); err != nil {
+			fmt.Fprintf(os.Stderr, "error resolving tag: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "resolved tag: %s\n", tag)
+		}
+	}
+
+	if format != "" {
+		var err error
+		if format_tmpl, err = parseFormat(format); err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing format: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if refs_file != "" {
+		aliases, err := loadAliases(refs_file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading references file: %s\n", err.Error())
+			os.Exit(1)
+		}
+		resolveAliases(aliases)
+	}
+
+	if previous_file != "" {
+		var err error
+		if previous, err = loadPrevious(previous_file); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading previous manifest: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if redact_file != "" {
+		var err error
+		if redaction, err = loadRedaction(redact_file); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading redaction config: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if output_format != "json" && output_format != "yaml" {
+		fmt.Fprintf(os.Stderr, "error: unknown output format %q\n", output_format)
+		os.Exit(1)
+	}
+
+	if output_format == "yaml" && len(pkeys) > 0 {
+		fmt.Fprintln(os.Stderr, "error: signed manifests cannot be emitted as yaml")
+		os.Exit(1)
+	}
+
+	if archive_out != "" && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "error: --archive-out accepts only a single tarball")
+		os.Exit(1)
+	}
+
+	if provenance_out != "" && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "error: --provenance accepts only a single tarball")
+		os.Exit(1)
+	}
+
+	if flatten && layout_out == "" {
+		fmt.Fprintln(os.Stderr, "warning: the flattened layer is only stored with --layout-out")
+	}
+
+	if jobs < 1 || compress_threads < 1 {
+		fmt.Fprintln(os.Stderr, "error: --jobs and --compress-threads must be at least 1")
+		os.Exit(1)
+	}
+
+	if err := checkDigestAlgorithm(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: --digest-algorithm: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if diff_ids {
+		for opt, set := range map[string]bool{
+			"--key-file":           len(pkeys) > 0,
+			"--layout-out":         layout_out != "",
+			"--archive-out":        archive_out != "",
+			"--provenance":         provenance_out != "",
+			"--previous":           previous_file != "",
+			"--simple-signing-dir": simple_sign_dir != "",
+		} {
+			if set {
+				fmt.Fprintf(os.Stderr, "error: --diff-ids cannot be used with %s\n", opt)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if digest_report != "" {
+		var err error
+		if digestReport.Algorithms, err = reportAlgorithms(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: --report-algorithm: %s\n", err.Error())
+			os.Exit(1)
+		}
+	} else if len(report_algorithms) > 0 {
+		fmt.Fprintln(os.Stderr, "warning: --report-algorithm has no effect without --digest-report")
+	}
+
+	if max_memory != "" {
+		limit, err := parseSize(max_memory)
+		if err == nil && limit == 0 {
+			err = errors.New("the limit must be above zero")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: --max-memory: %s\n", err.Error())
+			os.Exit(1)
+		}
+		limitMemory(limit)
+	}
+
+	if output != "" && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "error: --output accepts only a single tarball, use --output-dir")
+		os.Exit(1)
+	}
+
+	done := 0
+	for _, target := range flag.Args() {
+		if err := outputManifestFor(target, pkeys); err != nil {
+			failures = append(failures, fmt.Errorf("%s: %s", target, err.Error()))
+			if !keep_going {
+				break
+			}
+		} else {
+			done++
+		}
+	}
+
+	if digest_file != "" {
+		var b bytes.Buffer
+		for _, d := range digests {
+			fmt.Fprintln(&b, d)
+		}
+		if err := writeFileAtomic(digest_file, b.Bytes(), 0644); err != nil {
+			failures = append(failures, fmt.Errorf("error writing digest file: %s", err.Error()))
+		}
+	}
+
+	if digest_report != "" {
+		if err := writeDigestReport(digest_report); err != nil {
+			failures = append(failures, fmt.Errorf("error writing digest report: %s", err.Error()))
+		}
+	}
+
+	if len(failures) > 0 {
+		fmt.Fprintf(os.Stderr, "%d error(s) occurred:\n", len(failures))
+		for _, err := range failures {
+			fmt.Fprintf(os.Stderr, "  %s\n", err.Error())
+		}
+		if broken_chains > 0 {
+			os.Exit(exitBrokenChain)
+		}
+		// exit status 2 signals that some of the input was processed
+		if keep_going && done > 0 {
+			os.Exit(2)
 		}
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	flag "github.com/docker/docker/pkg/mflag"
+	"os"
+)
+
+type MediaType struct {
+	MediaType string `json:"mediaType"`
+	Kind      string `json:"kind"`
+	Schema    string `json:"schema"`
+	Read      bool   `json:"read"`
+	Write     bool   `json:"write"`
+}
+
+type MediaTypeCombination struct {
+	Schema   string   `json:"schema"`
+	Manifest string   `json:"manifest"`
+	Config   string   `json:"config,omitempty"`
+	Layers   []string `json:"layers"`
+}
+
+type MediaTypeMatrix struct {
+	MediaTypes   []MediaType            `json:"mediaTypes"`
+	Combinations []MediaTypeCombination `json:"combinations"`
+}
+
+var supportedMediaTypes = MediaTypeMatrix{
+	MediaTypes: []MediaType{
+		{"application/vnd.docker.distribution.manifest.v1+json", "manifest", "schema1", true, true},
+		{"application/vnd.docker.distribution.manifest.v1+prettyjws", "manifest", "schema1", true, true},
+		{"application/x-tar", "layer", "docker-archive", true, false},
+		{"application/vnd.docker.image.rootfs.diff.tar.gzip", "layer", "schema1", false, true},
+		{ociManifestMediaType, "manifest", "oci", true, true},
+		{ociEmptyMediaType, "config", "oci", false, true},
+		// only read by lint
+		{schema2MediaType, "manifest", "schema2", true, false},
+		{schema2ListMediaType, "index", "schema2", true, false},
+		{ociIndexMediaType, "index", "oci", true, false},
+	},
+	Combinations: []MediaTypeCombination{
+		{
+			Schema:   "schema1",
+			Manifest: "application/vnd.docker.distribution.manifest.v1+json",
+			Layers:   []string{"application/vnd.docker.image.rootfs.diff.tar.gzip"},
+		},
+		{
+			Schema:   "schema1",
+			Manifest: "application/vnd.docker.distribution.manifest.v1+prettyjws",
+			Layers:   []string{"application/vnd.docker.image.rootfs.diff.tar.gzip"},
+		},
+		{
+			Schema:   "schema2",
+			Manifest: schema2MediaType,
+			Config:   schema2ConfigMediaType,
+			Layers: []string{
+				"application/vnd.docker.image.rootfs.diff.tar.gzip",
+				"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+			},
+		},
+		{
+			Schema:   "oci",
+			Manifest: ociManifestMediaType,
+			Config:   ociEmptyMediaType,
+			Layers:   []string{"*/*"},
+		},
+	},
+}
+
+func cmdMediaTypes(args []string) error {
+	fs := flag.NewFlagSet("media-types", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return errors.New("media-types takes no arguments")
+	}
+
+	b, err := marshalDocument(supportedMediaTypes)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+const (
+	copyBufferSize = 32 << 10
+	// rough working set of a gzip stream, the compressor state plus buffers
+	gzipStreamMemory = 1 << 20
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { z, _ := gzip.NewWriterLevel(nil, layerCompressionLevel); return z }}
+	copyBuffers = sync.Pool{New: func() interface{} { b := make([]byte, copyBufferSize); return &b }}
+	pgzipBlocks = sync.Pool{New: func() interface{} { b := make([]byte, 0, pgzipBlockSize); return &b }}
+)
+
+// streamMemory estimates what compressing a single layer takes
+func streamMemory(threads int) int64 {
+	if threads <= 1 {
+		return gzipStreamMemory
+	}
+	// a block being filled and a block plus its output per thread
+	return int64(2*threads+1) * pgzipBlockSize
+}
+
+// limitMemory sets the soft limit of the garbage collector and lowers
+// --jobs and then --compress-threads until their estimated working set
+// fits into half of limit, leaving the rest for everything else
+func limitMemory(limit int64) {
+	debug.SetMemoryLimit(limit)
+
+	budget := limit / 2
+	j, c := jobs, compress_threads
+	for int64(j)*streamMemory(c) > budget && j > 1 {
+		j--
+	}
+	for int64(j)*streamMemory(c) > budget && c > 1 {
+		c--
+	}
+	if verbose && (j != jobs || c != compress_threads) {
+		fmt.Fprintf(os.Stderr, "memory limit: using %d jobs and %d compress threads\n", j, c)
+	}
+	jobs, compress_threads = j, c
+}
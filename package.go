@@ -0,0 +1,333 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	flag "github.com/docker/docker/pkg/mflag"
+	trust "github.com/docker/libtrust"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type PackageMetadata struct {
+	Name    string                   `json:"name"`
+	Tag     string                   `json:"tag"`
+	Digest  digest.Digest            `json:"digest"`
+	KeyIds  []string                 `json:"keyIds"`
+	Created time.Time                `json:"created"`
+	Files   map[string]digest.Digest `json:"files"`
+}
+
+type packageFile struct {
+	name string
+	data []byte
+}
+
+func cmdPackageManifest(args []string) error {
+	fs := flag.NewFlagSet("package-manifest", flag.ExitOnError)
+	out := fs.String([]string{"o", "-output"}, "", "Package file to write (default <manifest>.tar.gz)")
+	img := fs.String([]string{"-image"}, "", "Include the image tarball, making the package an archival one")
+	var sboms stringList
+	fs.Var(&sboms, []string{"-sbom"}, "Include an SBOM file in an archival package, may be repeated")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: package-manifest [-o PACKAGE] [--image TARBALL [--sbom FILE]...] MANIFEST")
+	}
+	if len(sboms) > 0 && *img == "" {
+		return errors.New("--sbom requires --image")
+	}
+
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	jsig, err := trust.ParsePrettySignature(b, "signatures")
+	if err != nil {
+		return fmt.Errorf("error parsing signed manifest: %s", err.Error())
+	}
+	keys, err := jsig.Verify()
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %s", err.Error())
+	}
+	payload, err := jsig.Payload()
+	if err != nil {
+		return err
+	}
+	sigs, err := jsig.Signatures()
+	if err != nil {
+		return err
+	}
+
+	var m manifest.Manifest
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return fmt.Errorf("error parsing manifest payload: %s", err.Error())
+	}
+
+	raw := make([]json.RawMessage, len(sigs))
+	for i, s := range sigs {
+		raw[i] = s
+	}
+	sb, err := json.MarshalIndent(raw, "", "   ")
+	if err != nil {
+		return err
+	}
+
+	files := []packageFile{{"manifest.json", b}, {"signatures.json", sb}}
+	for _, fn := range sboms {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		files = append(files, packageFile{"sbom/" + filepath.Base(fn), data})
+	}
+
+	meta := PackageMetadata{
+		Name:    m.Name,
+		Tag:     m.Tag,
+		Created: time.Now().UTC(),
+		Files:   map[string]digest.Digest{},
+	}
+	if meta.Digest, err = digest.FromBytes(payload); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		meta.KeyIds = append(meta.KeyIds, k.KeyID())
+	}
+	var vm *VerificationManifest
+	if *img != "" {
+		vm = newVerificationManifest(meta.Created)
+		if vm.Keys, err = verificationKeys(keys, sigs); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if meta.Files[f.name], err = digest.FromBytes(f.data); err != nil {
+			return err
+		}
+		if vm != nil {
+			vm.Files[f.name], _ = multiDigest(bytes.NewReader(f.data))
+		}
+	}
+
+	fn := *out
+	if fn == "" {
+		fn = fs.Arg(0) + ".tar.gz"
+	}
+
+	err = writeStreamAtomic(fn, 0644, func(w io.Writer) error {
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+		for _, f := range files {
+			if err := writeTarFile(tw, f.name, bytes.NewReader(f.data), int64(len(f.data)), meta.Created); err != nil {
+				return err
+			}
+		}
+
+		// the image is streamed and digested on the way into the package
+		if vm != nil {
+			f, err := os.Open(*img)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			st, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			md := newMultiDigester()
+			if err := writeTarFile(tw, "image.tar", io.TeeReader(f, md), st.Size(), meta.Created); err != nil {
+				return err
+			}
+			vm.Files["image.tar"] = md.Digests()
+			meta.Files["image.tar"] = vm.Files["image.tar"][0]
+
+			vb, err := json.MarshalIndent(vm, "", "   ")
+			if err != nil {
+				return err
+			}
+			if meta.Files["verification.json"], err = digest.FromBytes(vb); err != nil {
+				return err
+			}
+			if err := writeTarFile(tw, "verification.json", bytes.NewReader(vb), int64(len(vb)), meta.Created); err != nil {
+				return err
+			}
+		}
+
+		mb, err := json.MarshalIndent(meta, "", "   ")
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, "metadata.json", bytes.NewReader(mb), int64(len(mb)), meta.Created); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gw.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "packaged %s:%s to %s\n", m.Name, m.Tag, fn)
+	}
+	return nil
+}
+
+func cmdUnpackage(args []string) error {
+	fs := flag.NewFlagSet("unpackage", flag.ExitOnError)
+	out := fs.String([]string{"o", "-output"}, "", "Write the verified manifest to a file")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: unpackage [-o MANIFEST] PACKAGE")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	// everything but the image of archival packages is kept in memory, the
+	// image is spooled so its layers can be checked against the manifest
+	files := map[string][]byte{}
+	sums := map[string][]digest.Digest{}
+	image := ""
+	defer func() {
+		if image != "" {
+			os.Remove(image)
+		}
+	}()
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("error reading package: %s", err.Error())
+		}
+
+		var buf bytes.Buffer
+		var w io.Writer = &buf
+		var tmp *os.File
+		if hdr.Name == "image.tar" && image == "" {
+			if tmp, err = ioutil.TempFile("", ".docker-manifest-image-"); err != nil {
+				return err
+			}
+			image, w = tmp.Name(), tmp
+		}
+		md := newMultiDigester()
+		_, err = io.Copy(io.MultiWriter(w, md), tr)
+		if tmp != nil {
+			if cerr := tmp.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			return err
+		}
+		files[hdr.Name], sums[hdr.Name] = buf.Bytes(), md.Digests()
+	}
+
+	var meta PackageMetadata
+	if err := json.Unmarshal(files["metadata.json"], &meta); err != nil {
+		return fmt.Errorf("error parsing metadata.json: %s", err.Error())
+	}
+	for name, expected := range meta.Files {
+		if _, ok := sums[name]; !ok {
+			return fmt.Errorf("%s is missing from the package", name)
+		}
+		if !containsDigest(sums[name], expected) {
+			return fmt.Errorf("%s does not match its recorded digest", name)
+		}
+	}
+
+	if b, ok := files["verification.json"]; ok {
+		var vm VerificationManifest
+		if err := json.Unmarshal(b, &vm); err != nil {
+			return fmt.Errorf("error parsing verification.json: %s", err.Error())
+		}
+		for name, expected := range vm.Files {
+			if _, ok := sums[name]; !ok {
+				return fmt.Errorf("%s is missing from the package", name)
+			}
+			for _, d := range expected {
+				if _, err := digest.ParseDigest(string(d)); err != nil {
+					return fmt.Errorf("verification.json: bad digest %q of %s: %s", d, name, err.Error())
+				}
+				if !d.Algorithm().Available() {
+					fmt.Fprintf(os.Stderr, "warning: cannot check %s digest of %s\n", d.Algorithm(), name)
+				} else if !containsDigest(sums[name], d) {
+					return fmt.Errorf("%s does not match its recorded %s digest", name, d.Algorithm())
+				}
+			}
+		}
+		if verbose {
+			fmt.Fprintf(os.Stderr, "checked %d archived files with %d digest algorithms\n", len(vm.Files), len(vm.DigestAlgorithms))
+		}
+	}
+
+	jsig, err := trust.ParsePrettySignature(files["manifest.json"], "signatures")
+	if err != nil {
+		return fmt.Errorf("error parsing manifest.json: %s", err.Error())
+	}
+	keys, err := jsig.Verify()
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %s", err.Error())
+	}
+	payload, err := jsig.Payload()
+	if err != nil {
+		return err
+	}
+	d, err := digest.FromBytes(payload)
+	if err != nil {
+		return err
+	}
+	if d != meta.Digest {
+		return fmt.Errorf("manifest digest %s does not match recorded %s", d, meta.Digest)
+	}
+
+	// metadata.json and verification.json are not signed, so the image is
+	// only trusted once its layers match the signed fsLayers
+	if image != "" {
+		var m manifest.Manifest
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return fmt.Errorf("error parsing manifest payload: %s", err.Error())
+		}
+		var out io.Writer = ioutil.Discard
+		if verbose {
+			out = os.Stderr
+		}
+		if err := verifyImage(&m, image, out); err != nil {
+			return fmt.Errorf("image.tar does not match the signed manifest: %s", err.Error())
+		}
+	}
+
+	fmt.Printf("manifest: %s:%s\n", meta.Name, meta.Tag)
+	for _, k := range keys {
+		fmt.Printf("signed by: %s\n", k.KeyID())
+	}
+	fmt.Printf("digest: %s\n", d)
+
+	if *out != "" {
+		return writeFileAtomic(*out, files["manifest.json"], 0644)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+)
+
+const (
+	pgzipBlockSize = 1 << 20
+	// deflate back-references reach at most this far
+	pgzipWindow = 32 << 10
+)
+
+// parallelGzipWriter deflates blocks of its input on several goroutines.
+// Like pigz every block is compressed with the preceding 32KiB as its
+// dictionary and sync-flushed, so the blocks concatenate into one gzip
+// member. Block boundaries don't depend on the number of threads, so the
+// output is the same for any thread count, but differs from compress/gzip.
+type parallelGzipWriter struct {
+	w       io.Writer
+	threads int
+	block   []byte
+	window  []byte
+	pending []chan pgzipResult
+	crc     uint32
+	size    uint32
+	started bool
+	err     error
+}
+
+type pgzipResult struct {
+	b   []byte
+	err error
+}
+
+func newParallelGzipWriter(w io.Writer, threads int) *parallelGzipWriter {
+	return &parallelGzipWriter{w: w, threads: threads, block: (*pgzipBlocks.Get().(*[]byte))[:0]}
+}
+
+func (z *parallelGzipWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(z.block[len(z.block):cap(z.block)], p)
+		z.block = z.block[:len(z.block)+c]
+		p = p[c:]
+		if len(z.block) == cap(z.block) {
+			z.dispatch(false)
+			if z.err != nil {
+				return 0, z.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// dispatch hands the current block to a goroutine, writing out finished
+// blocks in order once all threads are busy
+func (z *parallelGzipWriter) dispatch(final bool) {
+	block, dict := z.block, z.window
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, block)
+	z.size += uint32(len(block))
+
+	w := append(append([]byte{}, z.window...), block...)
+	if len(w) > pgzipWindow {
+		w = w[len(w)-pgzipWindow:]
+	}
+	z.window = w
+	z.block = (*pgzipBlocks.Get().(*[]byte))[:0]
+
+	c := make(chan pgzipResult, 1)
+	go func() {
+		var b bytes.Buffer
+		fw, err := flate.NewWriterDict(&b, layerCompressionLevel, dict)
+		if err == nil {
+			_, err = fw.Write(block)
+		}
+		if err == nil && final {
+			err = fw.Close()
+		} else if err == nil {
+			err = fw.Flush()
+		}
+		pgzipBlocks.Put(&block)
+		c <- pgzipResult{b.Bytes(), err}
+	}()
+	z.pending = append(z.pending, c)
+
+	for len(z.pending) >= z.threads {
+		z.drain()
+	}
+}
+
+// drain writes out the oldest pending block
+func (z *parallelGzipWriter) drain() {
+	r := <-z.pending[0]
+	z.pending = z.pending[1:]
+	if z.err != nil {
+		return
+	}
+	if z.err = r.err; z.err != nil {
+		return
+	}
+	if !z.started {
+		// the header compress/gzip writes without name and mtime
+		_, z.err = z.w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255})
+		z.started = true
+		if z.err != nil {
+			return
+		}
+	}
+	_, z.err = z.w.Write(r.b)
+}
+
+func (z *parallelGzipWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	z.dispatch(true)
+	for len(z.pending) > 0 {
+		z.drain()
+	}
+	if z.err != nil {
+		return z.err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	_, z.err = z.w.Write(trailer[:])
+	return z.err
+}
+
+// layerCompression describes how layers are compressed, blob sums are
+// only reproducible with the same compressor
+func layerCompression() string {
+	switch {
+	case diff_ids:
+		return "none"
+	case compress_threads > 1:
+		return fmt.Sprintf("pgzip level %d, %d byte blocks, %s", layerCompressionLevel, pgzipBlockSize, runtime.Version())
+	}
+	return fmt.Sprintf("gzip level %d, %s", layerCompressionLevel, runtime.Version())
+}
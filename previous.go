@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+)
+
+// previousLayer is what an earlier manifest recorded about a layer, its
+// history entry only tells whether the layer was empty, the entry itself is
+// rebuilt from the tarball so the options of this run apply to it
+type previousLayer struct {
+	BlobSum digest.Digest
+	Data    string
+}
+
+func (p *previousLayer) throwaway() bool {
+	var v struct {
+		Throwaway bool `json:"throwaway"`
+	}
+	json.Unmarshal([]byte(p.Data), &v)
+	return v.Throwaway
+}
+
+// reusable reports whether the layer can be taken over without reading
+// its layer.tar, with --layout-out its blob has to be there already and
+// --digest-report needs digests the manifest doesn't have
+func (p *previousLayer) reusable() bool {
+	if p.BlobSum.Algorithm() != digest_algorithm || digest_report != "" {
+		return false
+	}
+	if layout_out == "" {
+		return true
+	}
+	_, err := os.Stat(blobPath(layout_out, p.BlobSum))
+	return err == nil
+}
+
+// loadPrevious indexes the layers of earlier output by id, fn holds a
+// single manifest or an array of them, signed or not
+func loadPrevious(fn string) (map[string]*previousLayer, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []json.RawMessage
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		if err := json.Unmarshal(b, &docs); err != nil {
+			return nil, err
+		}
+	} else {
+		docs = []json.RawMessage{b}
+	}
+
+	prev := map[string]*previousLayer{}
+	for _, doc := range docs {
+		if jsig, err := trust.ParsePrettySignature(doc, "signatures"); err == nil {
+			if doc, err = jsig.Payload(); err != nil {
+				return nil, err
+			}
+		}
+		var m manifest.Manifest
+		if err := json.Unmarshal(doc, &m); err != nil {
+			return nil, err
+		}
+		if len(m.FSLayers) != len(m.History) {
+			return nil, fmt.Errorf("manifest has %d fsLayers but %d history entries", len(m.FSLayers), len(m.History))
+		}
+		for i, h := range m.History {
+			_, id, err := getLayerInfo([]byte(h.V1Compatibility))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing history entry %d: %s", i, err.Error())
+			}
+			if _, err := digest.ParseDigest(string(m.FSLayers[i].BlobSum)); err != nil {
+				return nil, fmt.Errorf("fsLayers[%d]: bad blobSum %q: %s", i, m.FSLayers[i].BlobSum, err.Error())
+			}
+			prev[id] = &previousLayer{BlobSum: m.FSLayers[i].BlobSum, Data: h.V1Compatibility}
+		}
+	}
+	return prev, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v0.1"
+	inTotoPayloadType   = "application/vnd.in-toto+json"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v0.2"
+	provenanceBuildType = "https://github.com/shaded-enmity/docker-manifest/save-tarball@v1"
+)
+
+type InTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type SLSAMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+type InTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []InTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     SLSAProvenance  `json:"predicate"`
+}
+
+type SLSAProvenance struct {
+	Builder struct {
+		Id string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		Parameters map[string]interface{} `json:"parameters"`
+	} `json:"invocation"`
+	Metadata struct {
+		BuildStartedOn  time.Time `json:"buildStartedOn"`
+		BuildFinishedOn time.Time `json:"buildFinishedOn"`
+	} `json:"metadata"`
+	Materials []SLSAMaterial `json:"materials"`
+}
+
+// DSSEEnvelope wraps the statement when signing keys are given
+type DSSEEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []DSSESignature `json:"signatures"`
+}
+
+type DSSESignature struct {
+	KeyId string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+func digestMap(d digest.Digest) map[string]string {
+	return map[string]string{string(d.Algorithm()): d.Hex()}
+}
+
+// writeProvenance describes how the manifests of refs were produced from
+// the target tarball, manifests are identified by the digest a registry
+// would address them by
+func writeProvenance(fn, target string, started time.Time, refs []*ImageRef, manifests [][]byte, pkeys []trust.PrivateKey) error {
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	input, err := digest.FromReader(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	st := InTotoStatement{Type: inTotoStatementType, PredicateType: slsaProvenanceType}
+	for i, ref := range refs {
+		d, err := manifestDigest(manifests[i], len(pkeys) > 0)
+		if err != nil {
+			return err
+		}
+		st.Subject = append(st.Subject, InTotoSubject{Name: ref.Repo + ":" + ref.Tag, Digest: digestMap(d)})
+	}
+
+	p := &st.Predicate
+	p.Builder.Id = builder_id
+	p.BuildType = provenanceBuildType
+	p.Invocation.Parameters = map[string]interface{}{
+		"signed":               len(pkeys) > 0,
+		"keyIds":               keyIds(pkeys),
+		"trimHistory":          trim_history,
+		"stripContainerConfig": strip_container_config,
+		"skipBaseLayers":       []string(skip_base),
+		"flatten":              flatten,
+		"truncateCmd":          truncate_cmd,
+		"architecture":         architecture,
+		"os":                   os_name,
+		"throwaway":            throwaway,
+		"compression":          layerCompression(),
+		"digestAlgorithm":      digest_algorithm,
+		"compact":              compact,
+		"nameOverride":         name,
+		"tagOverride":          tag,
+		"select":               selected,
+	}
+	// the rules may name what they hide, so only their digest is recorded
+	if redact_file != "" {
+		rb, err := ioutil.ReadFile(redact_file)
+		if err != nil {
+			return err
+		}
+		rd, err := digest.FromBytes(rb)
+		if err != nil {
+			return err
+		}
+		p.Invocation.Parameters["redaction"] = digestMap(rd)
+	}
+	p.Metadata.BuildStartedOn = started.UTC()
+	p.Metadata.BuildFinishedOn = time.Now().UTC()
+	p.Materials = []SLSAMaterial{{URI: "file://" + filepath.ToSlash(target), Digest: digestMap(input)}}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{} = json.RawMessage(b)
+	if len(pkeys) > 0 {
+		env := DSSEEnvelope{PayloadType: inTotoPayloadType, Payload: base64.StdEncoding.EncodeToString(b)}
+		// DSSE signs the pre-authentication encoding of type and payload
+		pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(inTotoPayloadType), inTotoPayloadType, len(b), b)
+		for _, pkey := range pkeys {
+			sig, err := dsseSign(pkey, []byte(pae))
+			if err != nil {
+				return err
+			}
+			env.Signatures = append(env.Signatures, DSSESignature{KeyId: pkey.KeyID(), Sig: base64.StdEncoding.EncodeToString(sig)})
+		}
+		doc = env
+	}
+
+	out, err := marshalDocument(doc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, append(out, '\n'), 0644)
+}
+
+// dsseSign signs like DSSE verifiers expect, ECDSA signatures are ASN.1 DER
+// rather than the JWS r||s libtrust produces. The hash follows the curve
+func dsseSign(pkey trust.PrivateKey, pae []byte) ([]byte, error) {
+	hash := crypto.SHA256
+	if pub, ok := pkey.CryptoPublicKey().(*ecdsa.PublicKey); ok {
+		switch pub.Curve.Params().BitSize {
+		case 384:
+			hash = crypto.SHA384
+		case 521:
+			hash = crypto.SHA512
+		}
+	}
+
+	if signer, ok := pkey.CryptoPrivateKey().(crypto.Signer); ok {
+		h := hash.New()
+		h.Write(pae)
+		return signer.Sign(rand.Reader, h.Sum(nil), hash)
+	}
+
+	// keys held elsewhere, e.g. in Vault, only sign through libtrust
+	sig, _, err := pkey.Sign(bytes.NewReader(pae), hash)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := pkey.CryptoPublicKey().(*ecdsa.PublicKey); !ok {
+		return sig, nil
+	}
+	n := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProvenanceDSSEVerifies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-manifest-provenance-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(target, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, gen := range []func() (trust.PrivateKey, error){trust.GenerateECP256PrivateKey, trust.GenerateECP384PrivateKey} {
+		key, err := gen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		x, err := signPayload([]byte(`{"schemaVersion": 1, "name": "library/busybox", "tag": "latest"}`), []trust.PrivateKey{key})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fn := filepath.Join(dir, "provenance.json")
+		refs := []*ImageRef{{Repo: "library/busybox", Tag: "latest"}}
+		if err := writeProvenance(fn, target, time.Now(), refs, [][]byte{x}, []trust.PrivateKey{key}); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var env DSSEEnvelope
+		if err := json.Unmarshal(b, &env); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := base64.StdEncoding.DecodeString(env.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(env.Signatures) != 1 || env.Signatures[0].KeyId != key.KeyID() {
+			t.Fatalf("unexpected signatures %v", env.Signatures)
+		}
+		sig, err := base64.StdEncoding.DecodeString(env.Signatures[0].Sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pub := key.CryptoPublicKey().(*ecdsa.PublicKey)
+		hash := crypto.SHA256
+		if pub.Curve.Params().BitSize == 384 {
+			hash = crypto.SHA384
+		}
+		h := hash.New()
+		fmt.Fprintf(h, "DSSEv1 %d %s %d %s", len(env.PayloadType), env.PayloadType, len(payload), payload)
+		if !ecdsa.VerifyASN1(pub, h.Sum(nil), sig) {
+			t.Fatalf("%s signature does not verify", pub.Curve.Params().Name)
+		}
+	}
+}
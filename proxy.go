@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	flag "github.com/docker/docker/pkg/mflag"
+	trust "github.com/docker/libtrust"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+)
+
+const maxManifestSize = 4 << 20
+
+var (
+	manifestPathRe = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	blobPathRe     = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+)
+
+type verifyingProxy struct {
+	upstream *url.URL
+	client   *http.Client
+
+	// signed manifests must be signed by one of these key IDs or carry a
+	// chain that verifies against roots
+	trustedKeys map[string]bool
+	roots       *x509.CertPool
+}
+
+// errUntrusted is returned for manifests with valid signatures by keys the
+// proxy does not trust
+type errUntrusted struct {
+	keys []trust.PublicKey
+}
+
+func (e errUntrusted) Error() string {
+	ids := make([]string, len(e.keys))
+	for i, k := range e.keys {
+		ids[i] = k.KeyID()
+	}
+	return fmt.Sprintf("signed by untrusted keys %v", ids)
+}
+
+func cmdProxy(args []string) error {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := fs.String([]string{"l", "-listen"}, "127.0.0.1:5001", "Address to listen on")
+	upstream := fs.String([]string{"u", "-upstream"}, "", "URL of the upstream registry")
+	timeout := fs.Duration([]string{"-timeout"}, 10*time.Minute, "Give up on an upstream request, blob included, after this long")
+	ca := fs.String([]string{"-ca"}, "", "PEM bundle of CA certificates trusted to sign manifests through their x5c chain")
+	var keyFiles stringList
+	fs.Var(&keyFiles, []string{"-trusted-key"}, "Public key trusted to sign manifests, may be repeated")
+	fs.Parse(args)
+
+	if *upstream == "" {
+		return errors.New("--upstream is required")
+	}
+	if len(keyFiles) == 0 && *ca == "" {
+		return errors.New("at least one --trusted-key or --ca is required")
+	}
+	u, err := url.Parse(*upstream)
+	if err != nil {
+		return err
+	}
+
+	p := &verifyingProxy{upstream: u, client: &http.Client{Timeout: *timeout}, trustedKeys: map[string]bool{}}
+	for _, fn := range keyFiles {
+		k, err := trust.LoadPublicKeyFile(fn)
+		if err != nil {
+			return fmt.Errorf("error loading trusted key %s: %s", fn, err.Error())
+		}
+		p.trustedKeys[k.KeyID()] = true
+	}
+	if *ca != "" {
+		if p.roots, err = trust.LoadCertificatePool(*ca); err != nil {
+			return fmt.Errorf("error loading CA certificates: %s", err.Error())
+		}
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "proxying %s on %s\n", u, *listen)
+	}
+	return http.ListenAndServe(*listen, p)
+}
+
+func (p *verifyingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "read-only proxy", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := *p.upstream
+	u.Path, u.RawQuery = r.URL.Path, r.URL.RawQuery
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, h := range []string{"Accept", "Authorization", "User-Agent"} {
+		req.Header[h] = r.Header[h]
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if r.Method == "HEAD" || resp.StatusCode != http.StatusOK {
+		p.relay(w, resp, resp.Body)
+		return
+	}
+
+	if m := manifestPathRe.FindStringSubmatch(r.URL.Path); m != nil {
+		p.serveManifest(w, resp, m[2])
+	} else if m := blobPathRe.FindStringSubmatch(r.URL.Path); m != nil {
+		p.serveBlob(w, resp, m[2])
+	} else {
+		p.relay(w, resp, resp.Body)
+	}
+}
+
+func (p *verifyingProxy) relay(w http.ResponseWriter, resp *http.Response, body io.Reader) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, body)
+}
+
+func (p *verifyingProxy) refuse(w http.ResponseWriter, what string, err error) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "refusing %s: %s\n", what, err.Error())
+	}
+	status := http.StatusBadGateway
+	if _, ok := err.(errUntrusted); ok {
+		status = http.StatusForbidden
+	}
+	http.Error(w, fmt.Sprintf("verification of %s failed: %s", what, err.Error()), status)
+}
+
+func (p *verifyingProxy) serveManifest(w http.ResponseWriter, resp *http.Response, ref string) {
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if len(b) > maxManifestSize {
+		p.refuse(w, "manifest "+ref, errors.New("manifest too large"))
+		return
+	}
+
+	if err := p.verifyManifest(b, ref); err != nil {
+		p.refuse(w, "manifest "+ref, err)
+		return
+	}
+	p.relay(w, resp, bytes.NewReader(b))
+}
+
+// verifyManifest accepts signed schema1 manifests with valid signatures by
+// trusted signers and, when pulled by digest, any manifest whose content
+// matches the digest
+func (p *verifyingProxy) verifyManifest(b []byte, ref string) error {
+	var sm manifest.SignedManifest
+	signed := json.Unmarshal(b, &sm) == nil
+	if signed {
+		if err := p.verifySigners(&sm); err != nil {
+			return err
+		}
+	}
+
+	dgst, err := digest.ParseDigest(ref)
+	if err != nil {
+		if !signed {
+			return errors.New("unsigned manifest referenced by tag")
+		}
+		return nil
+	}
+
+	actual, err := manifestDigest(b, signed)
+	if err != nil {
+		return err
+	}
+	if actual != dgst {
+		return fmt.Errorf("content digest is %s", actual)
+	}
+	return nil
+}
+
+// verifySigners checks the signatures of sm and that one of them is by a
+// trusted key or has a chain to the trusted roots
+func (p *verifyingProxy) verifySigners(sm *manifest.SignedManifest) error {
+	keys, err := manifest.Verify(sm)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if p.trustedKeys[k.KeyID()] {
+			return nil
+		}
+	}
+
+	if p.roots != nil {
+		chains, err := manifest.VerifyChains(sm, p.roots)
+		if err != nil {
+			return errUntrusted{keys}
+		}
+		if len(chains) > 0 {
+			return nil
+		}
+	}
+	return errUntrusted{keys}
+}
+
+func (p *verifyingProxy) serveBlob(w http.ResponseWriter, resp *http.Response, ref string) {
+	dgst, err := digest.ParseDigest(ref)
+	if err != nil {
+		p.refuse(w, "blob "+ref, err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile("", "docker-manifest-blob-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	verifier, err := digest.NewDigestVerifier(dgst)
+	if err != nil {
+		p.refuse(w, "blob "+ref, err)
+		return
+	}
+	if _, err := io.Copy(io.MultiWriter(tmp, verifier), resp.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !verifier.Verified() {
+		p.refuse(w, "blob "+ref, errors.New("content does not match digest"))
+		return
+	}
+
+	if _, err := tmp.Seek(0, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.relay(w, resp, tmp)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	manifest "github.com/docker/distribution/manifest/schema1"
+	trust "github.com/docker/libtrust"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func signedManifestServer(t *testing.T, key trust.PrivateKey) *httptest.Server {
+	m := manifest.Manifest{Versioned: manifest.SchemaVersion, Name: "library/busybox", Tag: "latest", Architecture: "amd64"}
+	sm, err := manifest.Sign(&m, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(sm.Raw)
+	}))
+}
+
+func proxyGet(t *testing.T, upstream string, trusted ...trust.PrivateKey) int {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &verifyingProxy{upstream: u, client: http.DefaultClient, trustedKeys: map[string]bool{}}
+	for _, k := range trusted {
+		p.trustedKeys[k.KeyID()] = true
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/v2/library/busybox/manifests/latest", nil))
+	return w.Code
+}
+
+func TestProxyRefusesUntrustedSigner(t *testing.T) {
+	signer, err := trust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := trust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := signedManifestServer(t, signer)
+	defer upstream.Close()
+
+	if code := proxyGet(t, upstream.URL, trusted); code < 400 || code > 499 {
+		t.Fatalf("manifest self-signed with an unknown key served with %d", code)
+	}
+	if code := proxyGet(t, upstream.URL, trusted, signer); code != http.StatusOK {
+		t.Fatalf("manifest signed with a trusted key served with %d", code)
+	}
+}
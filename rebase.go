@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	flag "github.com/docker/docker/pkg/mflag"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// loadImageManifest reads a schema1 manifest, signed or not, or generates
+// the unsigned manifest of the image in a tarball selected by sel
+func loadImageManifest(fn, sel string) (*manifest.Manifest, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		layers, refs, err := readArchive(fn)
+		if err != nil {
+			return nil, err
+		}
+		refs = selectImages(refs, sel)
+		if len(refs) == 0 {
+			return nil, fmt.Errorf("%s: no matching images found", fn)
+		} else if len(refs) > 1 {
+			return nil, fmt.Errorf("%s: holds %d images, select one with --select", fn, len(refs))
+		}
+		if b, err = generateManifest(refs[0], layers, nil); err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err.Error())
+		}
+	} else if jsig, err := trust.ParsePrettySignature(b, "signatures"); err == nil {
+		if b, err = jsig.Payload(); err != nil {
+			return nil, err
+		}
+	}
+
+	var m manifest.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %s", fn, err.Error())
+	}
+	if len(m.FSLayers) != len(m.History) {
+		return nil, fmt.Errorf("manifest %s has %d fsLayers but %d history entries", fn, len(m.FSLayers), len(m.History))
+	}
+	return &m, nil
+}
+
+// setParent points the history entry data at a new parent id
+func setParent(data, parent string) (string, error) {
+	o, err := parseObject([]byte(data))
+	if err != nil {
+		return "", err
+	}
+	p, _ := json.Marshal(parent)
+	o.Set("parent", p)
+	b, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+// rebaseManifest replaces the bottom n layers of m by the layers of base
+func rebaseManifest(m, base *manifest.Manifest, n int) error {
+	if n <= 0 || n >= len(m.FSLayers) {
+		return fmt.Errorf("cannot replace %d of %d layers, at least one has to stay", n, len(m.FSLayers))
+	}
+	if len(base.FSLayers) == 0 {
+		return errors.New("new base has no layers")
+	}
+	if base.Architecture != m.Architecture {
+		return fmt.Errorf("new base is %s but the image is %s", base.Architecture, m.Architecture)
+	}
+
+	keep := len(m.FSLayers) - n
+	ids := map[string]bool{}
+	for _, h := range m.History[:keep] {
+		_, id, err := getLayerInfo([]byte(h.V1Compatibility))
+		if err != nil {
+			return fmt.Errorf("error parsing history of image: %s", err.Error())
+		}
+		ids[id] = true
+	}
+	for _, h := range base.History {
+		_, id, err := getLayerInfo([]byte(h.V1Compatibility))
+		if err != nil {
+			return fmt.Errorf("error parsing history of new base: %s", err.Error())
+		}
+		if ids[id] {
+			return fmt.Errorf("layer %s is part of both the image and the new base", id)
+		}
+	}
+	_, top, _ := getLayerInfo([]byte(base.History[0].V1Compatibility))
+	data, err := setParent(m.History[keep-1].V1Compatibility, top)
+	if err != nil {
+		return fmt.Errorf("error parsing history of layer %d: %s", keep-1, err.Error())
+	}
+	m.History[keep-1].V1Compatibility = data
+
+	m.FSLayers = append(m.FSLayers[:keep], base.FSLayers...)
+	m.History = append(m.History[:keep], base.History...)
+	return nil
+}
+
+// oldBaseLayers works out how many bottom layers of m belong to the old
+// base, given either as a count or as its manifest or tarball
+func oldBaseLayers(m *manifest.Manifest, old string) (int, error) {
+	if n, err := strconv.Atoi(old); err == nil {
+		return n, nil
+	}
+
+	base, err := loadImageManifest(old, "")
+	if err != nil {
+		return 0, err
+	}
+	n := len(base.FSLayers)
+	if n > len(m.FSLayers) {
+		return 0, fmt.Errorf("old base has %d layers, more than the image's %d", n, len(m.FSLayers))
+	}
+	for i, l := range base.FSLayers {
+		if j := len(m.FSLayers) - n + i; m.FSLayers[j].BlobSum != l.BlobSum {
+			return 0, fmt.Errorf("image is not based on %s, layer %d is %s instead of %s", old, j, m.FSLayers[j].BlobSum, l.BlobSum)
+		}
+	}
+	return n, nil
+}
+
+func cmdRebase(args []string) error {
+	fs := flag.NewFlagSet("rebase", flag.ExitOnError)
+	old := fs.String([]string{"-old-base"}, "", "Number of bottom layers to replace, or the manifest or tarball of the old base image")
+	newBase := fs.String([]string{"-new-base"}, "", "Manifest or tarball of the new base image")
+	var keyFiles stringList
+	fs.Var(&keyFiles, []string{"k", "-key-file"}, "Private key or directory of keys with which to sign the rebased manifest")
+	out := fs.String([]string{"o", "-output"}, "", "Write the manifest to a file instead of stdout")
+	fs.Parse(args)
+
+	if *old == "" || *newBase == "" || fs.NArg() != 1 {
+		return errors.New("usage: rebase --old-base N|OLD --new-base NEW [-k KEY] IMAGE")
+	}
+
+	m, err := loadImageManifest(fs.Arg(0), selected)
+	if err != nil {
+		return err
+	}
+	n, err := oldBaseLayers(m, *old)
+	if err != nil {
+		return err
+	}
+	base, err := loadImageManifest(*newBase, "")
+	if err != nil {
+		return err
+	}
+	if err := rebaseManifest(m, base, n); err != nil {
+		return fmt.Errorf("error rebasing: %s", err.Error())
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "replaced %d base layers of %s:%s by %d layers of %s:%s\n", n, m.Name, m.Tag, len(base.FSLayers), base.Name, base.Tag)
+	}
+
+	x, err := marshalDocument(m)
+	if err != nil {
+		return err
+	}
+
+	if len(keyFiles) == 0 {
+		keyFiles = key_files
+	}
+	if len(keyFiles) > 0 {
+		pkeys, err := loadKeys(keyFiles)
+		if err != nil {
+			return fmt.Errorf("error loading key: %s", err.Error())
+		}
+		if x, err = signPayload(x, pkeys); err != nil {
+			return err
+		}
+	}
+
+	if *out != "" {
+		return writeFileAtomic(*out, append(x, '\n'), 0644)
+	}
+	_, err = os.Stdout.Write(append(x, '\n'))
+	return err
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RedactionConfig maps label and environment variable name patterns to a
+// replacement value, a null value drops the entry altogether. The env rules
+// also cover the build args of RUN steps. Replace lists substrings rewritten
+// in every remaining label and env value and in the Cmd and Entrypoint
+type RedactionConfig struct {
+	Labels  map[string]*string `json:"labels"`
+	Env     map[string]*string `json:"env"`
+	Replace map[string]string  `json:"replace"`
+}
+
+func loadRedaction(fn string) (*RedactionConfig, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &RedactionConfig{}
+	if err := json.Unmarshal(b, rc); err != nil {
+		return nil, err
+	}
+	for _, m := range []map[string]*string{rc.Labels, rc.Env} {
+		for p := range m {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %s", p, err.Error())
+			}
+		}
+	}
+	return rc, nil
+}
+
+// match returns the rule for key, patterns are tried in lexical order so
+// the outcome doesn't depend on map iteration
+func (rc *RedactionConfig) match(rules map[string]*string, key string) (*string, bool) {
+	patterns := make([]string, 0, len(rules))
+	for p := range rules {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return rules[p], true
+		}
+	}
+	return nil, false
+}
+
+func (rc *RedactionConfig) rewrite(v string) string {
+	olds := make([]string, 0, len(rc.Replace))
+	for o := range rc.Replace {
+		olds = append(olds, o)
+	}
+	sort.Strings(olds)
+
+	for _, o := range olds {
+		v = strings.Replace(v, o, rc.Replace[o], -1)
+	}
+	return v
+}
+
+// redactHistory applies the config to the config and container_config
+// sections of a v1Compatibility entry, commands included
+func redactHistory(data string, rc *RedactionConfig) (string, error) {
+	o, err := parseObject([]byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	for _, section := range []string{"config", "container_config"} {
+		raw, ok := o.Get(section)
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		c, err := parseObject(raw)
+		if err != nil {
+			return "", fmt.Errorf("error parsing %s: %s", section, err.Error())
+		}
+		if err := rc.redactLabels(&c); err != nil {
+			return "", err
+		}
+		if err := rc.redactEnv(&c); err != nil {
+			return "", err
+		}
+		for _, key := range []string{"Cmd", "Entrypoint"} {
+			if err := rc.redactCommand(&c, key); err != nil {
+				return "", err
+			}
+		}
+		b, err := json.Marshal(c)
+		if err != nil {
+			return "", err
+		}
+		o.Set(section, b)
+	}
+
+	b, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+func (rc *RedactionConfig) redactLabels(c *jsonObject) error {
+	raw, ok := c.Get("Labels")
+	if !ok || string(raw) == "null" {
+		return nil
+	}
+	labels, err := parseObject(raw)
+	if err != nil {
+		return fmt.Errorf("error parsing labels: %s", err.Error())
+	}
+
+	out := jsonObject{}
+	for _, f := range labels {
+		var v string
+		if err := json.Unmarshal(f.Value, &v); err != nil {
+			return fmt.Errorf("error parsing label %s: %s", f.Key, err.Error())
+		}
+		if r, ok := rc.match(rc.Labels, f.Key); ok {
+			if r == nil {
+				continue
+			}
+			v = *r
+		}
+		b, _ := json.Marshal(rc.rewrite(v))
+		out = append(out, jsonField{Key: f.Key, Value: b})
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	c.Set("Labels", b)
+	return nil
+}
+
+func (rc *RedactionConfig) redactEnv(c *jsonObject) error {
+	raw, ok := c.Get("Env")
+	if !ok || string(raw) == "null" {
+		return nil
+	}
+	var env []string
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return fmt.Errorf("error parsing env: %s", err.Error())
+	}
+
+	out := make([]string, 0, len(env))
+	for _, e := range env {
+		if e, ok := rc.redactVar(e); ok {
+			out = append(out, e)
+		}
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	c.Set("Env", b)
+	return nil
+}
+
+// redactVar applies the env rules to a NAME=VALUE entry, ok is false when
+// it is dropped
+func (rc *RedactionConfig) redactVar(e string) (string, bool) {
+	i := strings.Index(e, "=")
+	if i < 0 {
+		// a bare name inherits its value, there is nothing to rewrite
+		r, ok := rc.match(rc.Env, e)
+		return e, !ok || r != nil
+	}
+	k, v := e[:i], e[i+1:]
+	if r, ok := rc.match(rc.Env, k); ok {
+		if r == nil {
+			return "", false
+		}
+		v = *r
+	}
+	return k + "=" + rc.rewrite(v), true
+}
+
+// redactCommand rewrites every argument of Cmd or Entrypoint. RUN steps with
+// build args are recorded as "|N", the N NAME=VALUE build args and then the
+// command, the env rules apply to those and N is adjusted to what remains
+func (rc *RedactionConfig) redactCommand(c *jsonObject, key string) error {
+	raw, ok := c.Get(key)
+	if !ok || string(raw) == "null" {
+		return nil
+	}
+	var args []string
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return fmt.Errorf("error parsing %s: %s", key, err.Error())
+	}
+
+	out := make([]string, 0, len(args))
+	if n, ok := buildArgCount(args); ok {
+		var vars []string
+		for _, e := range args[1 : 1+n] {
+			if e, ok := rc.redactVar(e); ok {
+				vars = append(vars, e)
+			}
+		}
+		out = append(append(out, "|"+strconv.Itoa(len(vars))), vars...)
+		args = args[1+n:]
+	}
+	for _, a := range args {
+		out = append(out, rc.rewrite(a))
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	c.Set(key, b)
+	return nil
+}
+
+// buildArgCount parses the "|N" prefix of a RUN step with build args
+func buildArgCount(args []string) (int, bool) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "|") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(args[0][1:])
+	if err != nil || n < 0 || n >= len(args) {
+		return 0, false
+	}
+	return n, true
+}
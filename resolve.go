@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func resolveTag(source string) (string, error) {
+	kind, arg := source, ""
+	if i := strings.Index(source, ":"); i >= 0 {
+		kind, arg = source[:i], source[i+1:]
+	}
+
+	var (
+		value string
+		err   error
+	)
+	switch kind {
+	case "git":
+		value, err = runResolver("git", "describe", "--tags", "--always", "--dirty")
+	case "env":
+		value = os.Getenv(arg)
+		if value == "" {
+			err = fmt.Errorf("environment variable %s is not set", arg)
+		}
+	case "file":
+		var b []byte
+		b, err = ioutil.ReadFile(arg)
+		value = string(b)
+	case "exec":
+		value, err = runResolver("/bin/sh", "-c", arg)
+	default:
+		err = fmt.Errorf("unknown tag source %q, expected git, env:VAR, file:PATH or exec:COMMAND", source)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return sanitizeTag(value)
+}
+
+func runResolver(name string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %s %s", name, err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// sanitizeTag turns the resolved value into a valid tag, which may only
+// contain [A-Za-z0-9_.-], must not start with . or - and is at most 128
+// characters long
+func sanitizeTag(v string) (string, error) {
+	v = invalidTagChars.ReplaceAllString(strings.TrimSpace(v), "-")
+	v = strings.TrimLeft(v, ".-")
+	if len(v) > 128 {
+		v = v[:128]
+	}
+	if v == "" {
+		return "", fmt.Errorf("resolved tag is empty")
+	}
+	return v, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	flag "github.com/docker/docker/pkg/mflag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// only entries of the docker-save layout are salvaged, after resynchronising
+// the scan may just as well land on a header inside a layer.tar
+var salvageEntry = regexp.MustCompile(`^([0-9a-f]{64})(/|/json|/layer\.tar|/VERSION)?$|^repositories$`)
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type salvager struct {
+	f       *os.File
+	tw      *tar.Writer
+	seen    map[string]bool
+	jsons   map[string]string
+	blobs   map[string]bool
+	repos   map[string]interface{}
+	lost    int
+	skipped int
+}
+
+// nextHeader scans 512 byte blocks from off on for something that looks
+// like a ustar header and returns a reader positioned on it
+func (s *salvager) nextHeader(off int64) (*tar.Reader, *countingReader, int64, error) {
+	off = (off + 511) &^ 511
+	block := make([]byte, 512)
+	for {
+		if _, err := s.f.ReadAt(block, off); err != nil {
+			return nil, nil, 0, io.EOF
+		}
+		if bytes.Equal(block[257:262], []byte("ustar")) {
+			if _, err := s.f.Seek(off, 0); err != nil {
+				return nil, nil, 0, err
+			}
+			cr := &countingReader{r: s.f, n: off}
+			return tar.NewReader(cr), cr, off, nil
+		}
+		off += 512
+	}
+}
+
+// copyEntry spools the entry to a temporary file first so that truncated or
+// unparseable content never makes it into the output
+func (s *salvager) copyEntry(hdr *tar.Header, r io.Reader, check func([]byte) error) error {
+	tmp, err := ioutil.TempFile("", ".docker-manifest-salvage-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if n != hdr.Size {
+		return io.ErrUnexpectedEOF
+	}
+
+	if check != nil {
+		if _, err := tmp.Seek(0, 0); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(tmp)
+		if err != nil {
+			return err
+		}
+		if err := check(data); err != nil {
+			return err
+		}
+	}
+
+	if s.tw != nil {
+		if _, err := tmp.Seek(0, 0); err != nil {
+			return err
+		}
+		if err := s.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(s.tw, tmp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *salvager) entry(hdr *tar.Header, r io.Reader) error {
+	m := salvageEntry.FindStringSubmatch(hdr.Name)
+	if m == nil || s.seen[hdr.Name] {
+		return nil
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		s.seen[hdr.Name] = true
+		if s.tw != nil {
+			return s.tw.WriteHeader(hdr)
+		}
+		return nil
+	}
+
+	var check func([]byte) error
+	switch {
+	case hdr.Name == "repositories":
+		// one of the wrong shape is lost too, so it gets recreated
+		check = func(b []byte) error {
+			var repos map[string]interface{}
+			if err := json.Unmarshal(b, &repos); err != nil {
+				return err
+			}
+			if _, err := getRepoInfo(repos); err != nil {
+				return err
+			}
+			s.repos = repos
+			return nil
+		}
+	case m[2] == "/json":
+		check = func(b []byte) error {
+			parent, _, err := getLayerInfo(b)
+			s.jsons[m[1]] = parent
+			return err
+		}
+	}
+
+	if err := s.copyEntry(hdr, r, check); err != nil {
+		delete(s.jsons, m[1])
+		fmt.Printf("LOST     %s: %s\n", hdr.Name, err.Error())
+		s.lost++
+		return nil
+	}
+
+	if m[2] == "/layer.tar" {
+		s.blobs[m[1]] = true
+	}
+	s.seen[hdr.Name] = true
+	fmt.Printf("OK       %s\n", hdr.Name)
+	return nil
+}
+
+func (s *salvager) scan() error {
+	t, cr, _, err := s.nextHeader(0)
+	if err != nil {
+		return errors.New("no tar headers found")
+	}
+
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			// resume at the block after the last header that was read
+			var at int64
+			if t, cr, at, err = s.nextHeader(cr.n); err != nil {
+				return nil
+			}
+			fmt.Printf("SKIPPED  corrupt data, resuming at offset %d\n", at)
+			s.skipped++
+			continue
+		}
+
+		start := cr.n
+		if err := s.entry(hdr, t); err != nil {
+			return err
+		}
+		// truncated or corrupt content leaves the reader unusable
+		if s.seen[hdr.Name] || !salvageEntry.MatchString(hdr.Name) {
+			continue
+		}
+		if t, cr, _, err = s.nextHeader(start); err != nil {
+			return nil
+		}
+	}
+}
+
+// chain returns the missing parts of the layer chain starting at top
+func (s *salvager) chain(top string) []string {
+	var missing []string
+	seen := map[string]bool{}
+	for id := top; id != ""; {
+		if seen[id] {
+			missing = append(missing, "an end to the parent cycle at "+id)
+			break
+		}
+		seen[id] = true
+		if !s.blobs[id] {
+			missing = append(missing, id+"/layer.tar")
+		}
+		parent, ok := s.jsons[id]
+		if !ok {
+			missing = append(missing, id+"/json")
+			break
+		}
+		id = parent
+	}
+	return missing
+}
+
+func cmdSalvage(args []string) error {
+	fs := flag.NewFlagSet("salvage", flag.ExitOnError)
+	out := fs.String([]string{"o", "-output"}, "", "Write every intact entry to a new tarball")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: salvage [-o OUTPUT] TARBALL")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := &salvager{f: f, seen: map[string]bool{}, jsons: map[string]string{}, blobs: map[string]bool{}}
+
+	var tmp *os.File
+	if *out != "" {
+		if tmp, err = ioutil.TempFile(filepath.Dir(*out), ".docker-manifest-"); err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		s.tw = tar.NewWriter(tmp)
+	}
+
+	if err := s.scan(); err != nil {
+		return err
+	}
+
+	var refs []*ImageRef
+	if s.repos != nil {
+		var err error
+		if refs, err = getRepoInfo(s.repos); err != nil {
+			return fmt.Errorf("error parsing repositories: %s", err.Error())
+		}
+	} else {
+		// without repositories every layer nothing else builds on is taken
+		// to be the top of an image
+		parents := map[string]bool{}
+		for _, p := range s.jsons {
+			parents[p] = true
+		}
+		ids := []string{}
+		for id := range s.jsons {
+			if !parents[id] {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+
+		tags := map[string]interface{}{}
+		for _, id := range ids {
+			if len(s.chain(id)) == 0 {
+				tags[id[:12]] = id
+				refs = append(refs, &ImageRef{Repo: "salvaged", Tag: id[:12], TopId: id})
+			}
+		}
+		if len(tags) > 0 {
+			s.repos = map[string]interface{}{"salvaged": tags}
+			if s.tw != nil {
+				b, _ := json.Marshal(s.repos)
+				if err := writeTarFile(s.tw, "repositories", bytes.NewReader(b), int64(len(b)), time.Now()); err != nil {
+					return err
+				}
+			}
+			fmt.Println("RECREATED repositories")
+		}
+	}
+
+	complete := 0
+	for _, ref := range refs {
+		if missing := s.chain(ref.TopId); len(missing) > 0 {
+			fmt.Printf("image %s:%s is incomplete, missing %s\n", ref.Repo, ref.Tag, strings.Join(missing, ", "))
+		} else {
+			fmt.Printf("image %s:%s is complete\n", ref.Repo, ref.Tag)
+			complete++
+		}
+	}
+
+	if s.tw != nil {
+		if err := s.tw.Close(); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), *out); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%d layers, %d of %d images complete, %d entries lost, %d corrupt regions skipped\n",
+		len(s.blobs), complete, len(refs), s.lost, s.skipped)
+	if s.lost > 0 || s.skipped > 0 || complete < len(refs) {
+		return errors.New("archive was damaged, see report above")
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	flag "github.com/docker/docker/pkg/mflag"
+	trust "github.com/docker/libtrust"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func cmdVerifySignature(args []string) error {
+	fs := flag.NewFlagSet("verify-signature", flag.ExitOnError)
+	expected := fs.String([]string{"-digest"}, "", "Expected digest of the manifest payload")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: verify-signature [--digest DIGEST] MANIFEST")
+	}
+
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	jsig, err := trust.ParsePrettySignature(b, "signatures")
+	if err != nil {
+		return fmt.Errorf("error parsing signed manifest: %s", err.Error())
+	}
+	payload, err := jsig.Payload()
+	if err != nil {
+		return err
+	}
+
+	var m manifest.Manifest
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return fmt.Errorf("error parsing manifest payload: %s", err.Error())
+	}
+	fmt.Printf("manifest: %s:%s\n", m.Name, m.Tag)
+
+	keys, err := jsig.Verify()
+	if err != nil {
+		return fmt.Errorf("signature verification failed: %s", err.Error())
+	}
+	for _, k := range keys {
+		fmt.Printf("signed by: %s\n", k.KeyID())
+	}
+
+	dgst, err := digest.FromBytes(payload)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("digest: %s\n", dgst)
+
+	if *expected != "" && digest.Digest(*expected) != dgst {
+		return fmt.Errorf("payload digest does not match %s", *expected)
+	}
+	return nil
+}
+
+func cmdCountersign(args []string) error {
+	fs := flag.NewFlagSet("countersign", flag.ExitOnError)
+	var keyFiles stringList
+	fs.Var(&keyFiles, []string{"k", "-key-file"}, "Private key or directory of keys with which to add signatures")
+	out := fs.String([]string{"o", "-output"}, "", "Write the manifest to a file instead of stdout")
+	fs.Parse(args)
+
+	if len(keyFiles) == 0 {
+		keyFiles = key_files
+	}
+	if len(keyFiles) == 0 || fs.NArg() != 1 {
+		return errors.New("usage: countersign --key-file KEY MANIFEST")
+	}
+
+	pkeys, err := loadKeys(keyFiles)
+	if err != nil {
+		return fmt.Errorf("error loading key: %s", err.Error())
+	}
+
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	jsig, err := trust.ParsePrettySignature(b, "signatures")
+	if err != nil {
+		return fmt.Errorf("error parsing signed manifest: %s", err.Error())
+	}
+	if _, err := jsig.Verify(); err != nil {
+		return fmt.Errorf("existing signatures do not verify: %s", err.Error())
+	}
+
+	for _, pkey := range pkeys {
+		if err := jsig.Sign(pkey); err != nil {
+			return err
+		}
+	}
+	x, err := jsig.PrettySignature("signatures")
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "countersigned with: %s\n", strings.Join(keyIds(pkeys), ", "))
+	}
+
+	if *out != "" {
+		return writeFileAtomic(*out, append(x, '\n'), 0644)
+	}
+	_, err = os.Stdout.Write(append(x, '\n'))
+	return err
+}
+
+func cmdStripSignatures(args []string) error {
+	fs := flag.NewFlagSet("strip-signatures", flag.ExitOnError)
+	out := fs.String([]string{"o", "-output"}, "", "Write the manifest to a file instead of stdout")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: strip-signatures [-o OUTPUT] MANIFEST")
+	}
+
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	jsig, err := trust.ParsePrettySignature(b, "signatures")
+	if err != nil {
+		return fmt.Errorf("error parsing signed manifest: %s", err.Error())
+	}
+	payload, err := jsig.Payload()
+	if err != nil {
+		return err
+	}
+
+	if *out != "" {
+		return writeFileAtomic(*out, append(payload, '\n'), 0644)
+	}
+	_, err = os.Stdout.Write(append(payload, '\n'))
+	return err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// SimpleSigningClaims is the payload of an atomic container signature as
+// consumed by containers/image (podman, CRI-O, skopeo)
+type SimpleSigningClaims struct {
+	Critical struct {
+		Type  string `json:"type"`
+		Image struct {
+			DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+	} `json:"critical"`
+	Optional struct {
+		Creator   string `json:"creator"`
+		Timestamp int64  `json:"timestamp"`
+	} `json:"optional"`
+}
+
+// writeSimpleSignature GPG-signs the claims for the manifest and stores them
+// using the lookaside layout, <dir>/<repo>@<algorithm>=<hex>/signature-<n>
+func writeSimpleSignature(dir, registry string, ref *ImageRef, dgst digest.Digest) (string, error) {
+	var c SimpleSigningClaims
+	c.Critical.Type = "atomic container signature"
+	c.Critical.Image.DockerManifestDigest = dgst
+	c.Critical.Identity.DockerReference = fmt.Sprintf("%s/%s:%s", registry, ref.Repo, ref.Tag)
+	c.Optional.Creator = "docker-manifest"
+	c.Optional.Timestamp = time.Now().Unix()
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"--batch", "--no-tty", "--sign"}
+	if gpg_key != "" {
+		args = append(args, "--local-user", gpg_key)
+	}
+	gpg := os.Getenv("GPG")
+	if gpg == "" {
+		gpg = "gpg"
+	}
+
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(gpg, args...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %s", err.Error(), bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	sigdir := filepath.Join(dir, filepath.FromSlash(ref.Repo)+"@"+string(dgst.Algorithm())+"="+dgst.Hex())
+	if err := os.MkdirAll(sigdir, 0755); err != nil {
+		return "", err
+	}
+
+	// keep signatures made earlier, e.g. by other keys
+	for i := 1; ; i++ {
+		fn := filepath.Join(sigdir, fmt.Sprintf("signature-%d", i))
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			return fn, writeFileAtomic(fn, out.Bytes(), 0644)
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"strconv"
+	"strings"
+)
+
+// skippedBaseLayers counts the layers at the bottom of chain (top first)
+// left out by --skip-base-layers, each spec is either a number of layers
+// or the id or blob sum of a layer; matching stops at the first layer
+// from the bottom that is not selected
+func skippedBaseLayers(chain []*Layer, specs []string) (int, error) {
+	count := 0
+	match := map[string]bool{}
+	for _, s := range specs {
+		if n, err := strconv.Atoi(s); err == nil {
+			if n < 0 {
+				return 0, fmt.Errorf("invalid layer count %d", n)
+			}
+			if n > count {
+				count = n
+			}
+		} else if strings.Contains(s, ":") {
+			if _, err := digest.ParseDigest(s); err != nil {
+				return 0, fmt.Errorf("invalid digest %q: %s", s, err.Error())
+			}
+			match[s] = true
+		} else {
+			match[s] = true
+		}
+	}
+
+	skip := 0
+	for i := len(chain) - 1; i >= 0; i-- {
+		l := chain[i]
+		if skip >= count && !match[l.Id] && !match[string(l.BlobSum)] {
+			break
+		}
+		skip++
+	}
+	if skip >= len(chain) {
+		return 0, fmt.Errorf("skipping %d base layers leaves none of the %d layers", skip, len(chain))
+	}
+	return skip, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// zeroWriter records whether anything but zero bytes was written to it, a
+// layer.tar made of nothing but the end-of-archive blocks adds no files
+type zeroWriter struct {
+	nonzero bool
+}
+
+func (z *zeroWriter) Write(p []byte) (int, error) {
+	if !z.nonzero {
+		for _, c := range p {
+			if c != 0 {
+				z.nonzero = true
+				break
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// markThrowaway flags the history entry of an empty layer the way the
+// registry's schema1 builder does, so pulls skip downloading its blob
+func markThrowaway(data string) (string, error) {
+	o, err := parseObject([]byte(data))
+	if err != nil {
+		return "", err
+	}
+	o.Set("throwaway", json.RawMessage("true"))
+	b, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	"os"
+	"time"
+)
+
+// LogEntry is a single line of the signing log, Prev is the digest of the
+// preceding line so that rewriting or dropping any entry breaks the chain
+type LogEntry struct {
+	Seq    int           `json:"seq"`
+	Time   string        `json:"time"`
+	Name   string        `json:"name"`
+	Tag    string        `json:"tag"`
+	Digest digest.Digest `json:"digest"`
+	KeyIds []string      `json:"keyIds,omitempty"`
+	Prev   digest.Digest `json:"prev,omitempty"`
+}
+
+// readLog verifies the chain of the log in fn and returns the number of
+// entries along with the digest of the last one
+func readLog(fn string) (int, digest.Digest, error) {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	} else if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	var (
+		n    int
+		head digest.Digest
+	)
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := s.Bytes()
+		var e LogEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return n, head, fmt.Errorf("entry %d: %s", n+1, err.Error())
+		}
+		if e.Seq != n+1 {
+			return n, head, fmt.Errorf("entry %d: unexpected sequence number %d", n+1, e.Seq)
+		}
+		if e.Prev != head {
+			return n, head, fmt.Errorf("entry %d: chain broken, expected prev %q got %q", n+1, head, e.Prev)
+		}
+		if head, err = digest.FromBytes(line); err != nil {
+			return n, head, err
+		}
+		n++
+	}
+	return n, head, s.Err()
+}
+
+func appendLog(fn string, ref *ImageRef, dgst digest.Digest, ids []string) error {
+	n, head, err := readLog(fn)
+	if err != nil {
+		return fmt.Errorf("refusing to append to %s: %s", fn, err.Error())
+	}
+
+	b, err := json.Marshal(&LogEntry{
+		Seq:    n + 1,
+		Time:   time.Now().UTC().Format(time.RFC3339),
+		Name:   ref.Repo,
+		Tag:    ref.Tag,
+		Digest: dgst,
+		KeyIds: ids,
+		Prev:   head,
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func cmdLog(args []string) error {
+	if len(args) != 2 || args[0] != "verify" {
+		return errors.New("usage: log verify FILE")
+	}
+
+	n, head, err := readLog(args[1])
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s holds no entries", args[1])
+	}
+
+	fmt.Printf("OK: %d entries\n", n)
+	fmt.Printf("head: %s\n", head)
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	flag "github.com/docker/docker/pkg/mflag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+type archiveEntries struct {
+	jsons        map[string]string
+	layerTars    map[string]bool
+	repositories map[string]interface{}
+	manifestJSON bool
+}
+
+func scanArchive(target string) (*archiveEntries, []string, error) {
+	f, err := os.Open(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var problems []string
+	a := &archiveEntries{jsons: map[string]string{}, layerTars: map[string]bool{}}
+	t := tar.NewReader(bufio.NewReader(f))
+	last := "start of archive"
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			problems = append(problems, fmt.Sprintf("archive is unreadable after %s: %s", last, err.Error()))
+			break
+		}
+		last = hdr.Name
+
+		switch {
+		case path.Base(hdr.Name) == "layer.tar":
+			a.layerTars[getLayerPrefix(hdr.Name)] = true
+		case path.Base(hdr.Name) == "json" && path.Dir(hdr.Name) != ".":
+			dir := getLayerPrefix(hdr.Name)
+			data, err := ioutil.ReadAll(t)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", hdr.Name, err.Error()))
+				continue
+			}
+			parent, id, err := getLayerInfo(data)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", hdr.Name, err.Error()))
+				continue
+			}
+			if id != dir {
+				problems = append(problems, fmt.Sprintf("%s: id %s does not match its directory", hdr.Name, id))
+			}
+			a.jsons[dir] = parent
+		case hdr.Name == "repositories":
+			data, err := ioutil.ReadAll(t)
+			if err == nil {
+				err = json.Unmarshal(data, &a.repositories)
+			}
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", hdr.Name, err.Error()))
+			}
+		case hdr.Name == "manifest.json":
+			a.manifestJSON = true
+		}
+	}
+	return a, problems, nil
+}
+
+func cmdValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return errors.New("usage: validate TARBALL...")
+	}
+
+	invalid := 0
+	for _, target := range fs.Args() {
+		a, problems, err := scanArchive(target)
+		if err != nil {
+			return err
+		}
+		var warnings []string
+
+		ids := []string{}
+		for id := range a.jsons {
+			ids = append(ids, id)
+		}
+		for id := range a.layerTars {
+			if _, ok := a.jsons[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			if _, ok := a.jsons[id]; !ok {
+				problems = append(problems, fmt.Sprintf("layer %s has no json", id))
+			}
+			if !a.layerTars[id] {
+				problems = append(problems, fmt.Sprintf("layer %s has no layer.tar", id))
+			}
+		}
+
+		if a.repositories == nil {
+			problems = append(problems, "repositories is missing, no images are tagged")
+		}
+		if a.manifestJSON {
+			warnings = append(warnings, "manifest.json (docker 1.10+ save format) is ignored, only repositories is used")
+		}
+
+		refs, err := getRepoInfo(a.repositories)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("repositories: %s", err.Error()))
+		}
+
+		reachable := map[string]bool{}
+		for _, ref := range refs {
+			seen := map[string]bool{}
+			for id, child := ref.TopId, ""; id != ""; child, id = id, a.jsons[id] {
+				if seen[id] {
+					problems = append(problems, fmt.Sprintf("%s:%s: layer chain has a cycle at %s", ref.Repo, ref.Tag, id))
+					break
+				}
+				seen[id], reachable[id] = true, true
+				// layers with a layer.tar but no json were reported above
+				if _, ok := a.jsons[id]; !ok {
+					if a.layerTars[id] {
+						break
+					}
+					if child == "" {
+						problems = append(problems, fmt.Sprintf("%s:%s: top layer %s is missing", ref.Repo, ref.Tag, id))
+					} else {
+						problems = append(problems, fmt.Sprintf("%s:%s: layer %s, parent of %s, is missing", ref.Repo, ref.Tag, id, child))
+					}
+					break
+				}
+			}
+		}
+		for _, id := range ids {
+			if !reachable[id] {
+				warnings = append(warnings, fmt.Sprintf("layer %s is not part of any tagged image", id))
+			}
+		}
+
+		for _, w := range warnings {
+			fmt.Printf("%s: WARNING %s\n", target, w)
+		}
+		for _, p := range problems {
+			fmt.Printf("%s: ERROR   %s\n", target, p)
+		}
+		if len(problems) > 0 {
+			invalid++
+		} else {
+			fmt.Printf("%s: OK, %d layers, %d images\n", target, len(ids), len(refs))
+		}
+	}
+
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d tarballs are invalid", invalid, fs.NArg())
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	trust "github.com/docker/libtrust"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// publicKey lets vaultKey embed the public half without the field clashing
+// with the PublicKey method of trust.PrivateKey
+type publicKey trust.PublicKey
+
+// vaultKey signs through the transit secrets engine of a Vault server, the
+// private key never leaves Vault and only the public half is fetched
+type vaultKey struct {
+	publicKey
+	addr, mount, name, token string
+	version                  int
+	alg                      string
+	hash                     string
+}
+
+// vaultAlgorithms maps transit key types to the JWS algorithm and the hash
+// Vault has to apply to produce it
+var vaultAlgorithms = map[string][2]string{
+	"ecdsa-p256": {"ES256", "sha2-256"},
+	"ecdsa-p384": {"ES384", "sha2-384"},
+	"ecdsa-p521": {"ES512", "sha2-512"},
+	"rsa-2048":   {"RS256", "sha2-256"},
+	"rsa-3072":   {"RS256", "sha2-256"},
+	"rsa-4096":   {"RS256", "sha2-256"},
+}
+
+type vaultKeyInfo struct {
+	Data struct {
+		Type          string                     `json:"type"`
+		LatestVersion int                        `json:"latest_version"`
+		Keys          map[string]json.RawMessage `json:"keys"`
+	} `json:"data"`
+}
+
+// loadVaultKey looks up the transit key given as NAME or MOUNT/NAME, the
+// token is taken from VAULT_TOKEN
+func loadVaultKey(addr, key string) (trust.PrivateKey, error) {
+	if addr == "" {
+		return nil, errors.New("--vault-addr or VAULT_ADDR is required")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return nil, errors.New("VAULT_TOKEN is not set")
+	}
+
+	k := &vaultKey{addr: strings.TrimSuffix(addr, "/"), mount: "transit", name: key, token: token}
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		k.mount, k.name = key[:i], key[i+1:]
+	}
+
+	var info vaultKeyInfo
+	if err := k.call("GET", "keys/"+k.name, nil, &info); err != nil {
+		return nil, err
+	}
+
+	alg, ok := vaultAlgorithms[info.Data.Type]
+	if !ok {
+		return nil, fmt.Errorf("transit key %s has unsupported type %q", key, info.Data.Type)
+	}
+	k.alg, k.hash, k.version = alg[0], alg[1], info.Data.LatestVersion
+
+	var version struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.Unmarshal(info.Data.Keys[strconv.Itoa(k.version)], &version); err != nil || version.PublicKey == "" {
+		return nil, fmt.Errorf("transit key %s does not expose a public key for version %d", key, k.version)
+	}
+	block, _ := pem.Decode([]byte(version.PublicKey))
+	if block == nil {
+		return nil, fmt.Errorf("transit key %s: no PEM data in public key", key)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("transit key %s: %s", key, err.Error())
+	}
+	if k.publicKey, err = trust.FromCryptoPublicKey(pub); err != nil {
+		return nil, fmt.Errorf("transit key %s: %s", key, err.Error())
+	}
+	return k, nil
+}
+
+func (k *vaultKey) call(method, p string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s/%s", k.addr, k.mount, p), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", k.token)
+
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var verr struct {
+			Errors []string `json:"errors"`
+		}
+		json.Unmarshal(b, &verr)
+		if len(verr.Errors) > 0 {
+			return fmt.Errorf("vault: %s", strings.Join(verr.Errors, ", "))
+		}
+		return fmt.Errorf("vault: unexpected status %s", resp.Status)
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (k *vaultKey) PublicKey() trust.PublicKey {
+	return k.publicKey
+}
+
+func (k *vaultKey) CryptoPrivateKey() crypto.PrivateKey {
+	return nil
+}
+
+// Sign ignores hashID, the hash is dictated by the key type just like it is
+// for libtrust EC keys
+func (k *vaultKey) Sign(data io.Reader, hashID crypto.Hash) ([]byte, string, error) {
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req := map[string]interface{}{
+		"input":                base64.StdEncoding.EncodeToString(b),
+		"key_version":          k.version,
+		"marshaling_algorithm": "jws",
+	}
+	if _, ok := k.CryptoPublicKey().(*ecdsa.PublicKey); !ok {
+		req["signature_algorithm"] = "pkcs1v15"
+	}
+
+	var resp struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	if err := k.call("POST", fmt.Sprintf("sign/%s/%s", k.name, k.hash), req, &resp); err != nil {
+		return nil, "", err
+	}
+
+	// signatures come back as vault:v<version>:<base64url>
+	parts := strings.SplitN(resp.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, "", fmt.Errorf("vault: malformed signature %q", resp.Data.Signature)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, "", fmt.Errorf("vault: malformed signature: %s", err.Error())
+	}
+	return sig, k.alg, nil
+}
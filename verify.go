@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/distribution/digest"
+	manifest "github.com/docker/distribution/manifest/schema1"
+	flag "github.com/docker/docker/pkg/mflag"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+func cmdVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	mfile := fs.String([]string{"m", "-manifest"}, "", "Manifest to check the tarball against")
+	fs.Parse(args)
+
+	if *mfile == "" || fs.NArg() != 1 {
+		return errors.New("usage: verify --manifest MANIFEST TARBALL")
+	}
+
+	b, err := ioutil.ReadFile(*mfile)
+	if err != nil {
+		return err
+	}
+	var m manifest.Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("error parsing manifest: %s", err.Error())
+	}
+	return verifyImage(&m, fs.Arg(0), os.Stdout)
+}
+
+// verifyImage recomputes the blob sums of the tarball fn and compares them
+// to the fsLayers of m, writing a line per layer to out
+func verifyImage(m *manifest.Manifest, fn string, out io.Writer) error {
+	if len(m.FSLayers) != len(m.History) {
+		return fmt.Errorf("manifest has %d fsLayers but %d history entries", len(m.FSLayers), len(m.History))
+	}
+
+	// readArchive is steered by globals, they are set up for recomputing
+	// blob sums here and restored for whatever runs afterwards
+	defer func(alg digest.Algorithm, cache, layout, report string, prev map[string]*previousLayer, diffIDs bool) {
+		digest_algorithm, blob_cache, layout_out, digest_report, previous, diff_ids = alg, cache, layout, report, prev, diffIDs
+	}(digest_algorithm, blob_cache, layout_out, digest_report, previous, diff_ids)
+
+	// recompute the blob sums with whatever algorithm the manifest uses
+	for i, fsl := range m.FSLayers {
+		if _, err := digest.ParseDigest(string(fsl.BlobSum)); err != nil {
+			return fmt.Errorf("fsLayers[%d]: bad blobSum %q: %s", i, fsl.BlobSum, err.Error())
+		}
+	}
+	if len(m.FSLayers) > 0 {
+		digest_algorithm = m.FSLayers[0].BlobSum.Algorithm()
+		if err := checkDigestAlgorithm(); err != nil {
+			return fmt.Errorf("cannot recompute blob sums: %s", err.Error())
+		}
+	}
+
+	// the point is to recompute every sum, not to trust earlier runs, and
+	// neither to store blobs nor to digest the uncompressed layers
+	blob_cache, previous = "", nil
+	layout_out, digest_report, diff_ids = "", "", false
+
+	layers, _, err := readArchive(fn)
+	if err != nil {
+		return err
+	}
+
+	mismatches := 0
+	for i, fsl := range m.FSLayers {
+		_, id, err := getLayerInfo([]byte(m.History[i].V1Compatibility))
+		if err != nil {
+			return fmt.Errorf("error parsing history entry %d: %s", i, err.Error())
+		}
+
+		l, ok := layers[id]
+		switch {
+		case !ok || l.BlobSum == "":
+			fmt.Fprintf(out, "MISSING  %s %s\n", id, fsl.BlobSum)
+			mismatches++
+		case l.BlobSum != fsl.BlobSum:
+			fmt.Fprintf(out, "MISMATCH %s expected %s, got %s\n", id, fsl.BlobSum, l.BlobSum)
+			mismatches++
+		default:
+			fmt.Fprintf(out, "OK       %s %s\n", id, fsl.BlobSum)
+		}
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("%d of %d layers do not match the manifest", mismatches, len(m.FSLayers))
+	}
+	return nil
+}
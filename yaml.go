@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// toYAML converts a JSON document to block style YAML, keeping the order of
+// object keys. Strings are written as JSON quoted scalars, which YAML
+// accepts verbatim.
+func toYAML(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeYAML(&buf, json.RawMessage(b), 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeYAML(buf *bytes.Buffer, v json.RawMessage, indent int) error {
+	v = bytes.TrimSpace(v)
+	pad := strings.Repeat("  ", indent)
+
+	switch {
+	case len(v) > 0 && v[0] == '{':
+		o, err := parseObject(v)
+		if err != nil {
+			return err
+		}
+		if len(o) == 0 {
+			buf.WriteString(pad + "{}\n")
+			return nil
+		}
+		for _, f := range o {
+			buf.WriteString(pad + yamlKey(f.Key) + ":")
+			if err := writeYAMLValue(buf, f.Value, indent); err != nil {
+				return err
+			}
+		}
+	case len(v) > 0 && v[0] == '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(v, &items); err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			buf.WriteString(pad + "[]\n")
+			return nil
+		}
+		for _, item := range items {
+			// render the item one level deeper and turn the indentation of
+			// its first line into the sequence dash
+			var ib bytes.Buffer
+			if err := writeYAML(&ib, item, indent+1); err != nil {
+				return err
+			}
+			buf.WriteString(pad + "- ")
+			buf.Write(ib.Bytes()[len(pad)+2:])
+		}
+	default:
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, v); err != nil {
+			return err
+		}
+		buf.WriteString(pad)
+		buf.Write(compacted.Bytes())
+		buf.WriteByte('\n')
+	}
+	return nil
+}
+
+func yamlKey(k string) string {
+	plain := k != "" && strings.Trim(k, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-.") == ""
+	if plain && strings.IndexAny(k[:1], "0123456789-.") == -1 {
+		switch strings.ToLower(k) {
+		case "true", "false", "yes", "no", "on", "off", "y", "n", "null":
+		default:
+			return k
+		}
+	}
+	b, _ := json.Marshal(k)
+	return string(b)
+}
+
+func writeYAMLValue(buf *bytes.Buffer, v json.RawMessage, indent int) error {
+	v = bytes.TrimSpace(v)
+	if len(v) > 2 && (v[0] == '{' || v[0] == '[') {
+		buf.WriteByte('\n')
+		return writeYAML(buf, v, indent+1)
+	}
+	buf.WriteByte(' ')
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, v); err != nil {
+		return err
+	}
+	buf.Write(compacted.Bytes())
+	buf.WriteByte('\n')
+	return nil
+}